@@ -0,0 +1,212 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tiltfactor/toto/domain"
+)
+
+// AdminGame describes a loaded game and the players waiting in its lobby
+type AdminGame struct {
+	UUID       string        `json:"uniqueKey"`
+	Title      string        `json:"displayTitle"`
+	FileName   string        `json:"fileName"`
+	MinPlayers int           `json:"minPlayers"`
+	MaxPlayers int           `json:"maxPlayers"`
+	Retired    bool          `json:"retired"`
+	Rooms      int           `json:"rooms"`
+	Queue      []AdminQueued `json:"queue"`
+}
+
+// AdminQueued describes a player waiting in a lobby and for how long
+type AdminQueued struct {
+	ID          string    `json:"id"`
+	QueuedAt    time.Time `json:"queuedAt"`
+	WaitSeconds float64   `json:"waitSeconds"`
+}
+
+// AdminRoom describes a running room and who sits in it
+type AdminRoom struct {
+	Name         string      `json:"roomName"`
+	GameID       string      `json:"gameId"`
+	CurrentTurn  int         `json:"currentTurn"`
+	StateVersion int         `json:"stateVersion"`
+	Seats        []AdminSeat `json:"seats"`
+	Spectators   []string    `json:"spectators"`
+}
+
+// AdminSeat describes a seat of a room. Vacant seats have no id and seats
+// held for a disconnected player are not connected.
+type AdminSeat struct {
+	Turn      int    `json:"turnNumber"`
+	ID        string `json:"id,omitempty"`
+	Connected bool   `json:"connected"`
+}
+
+// AdminGames lists the loaded games ordered by unique key
+func AdminGames(games *domain.GameStore, info Control) []AdminGame {
+	list := []AdminGame{}
+	for _, g := range games.All() {
+		ag := AdminGame{
+			UUID:       g.UUID,
+			Title:      g.Title,
+			FileName:   g.FileName,
+			MinPlayers: g.MinPlayers,
+			MaxPlayers: g.MaxPlayers,
+			Retired:    g.Retired,
+			Rooms:      info.Rooms.CountGame(g.UUID),
+			Queue:      []AdminQueued{},
+		}
+		for _, p := range g.Lobby.Queued() {
+			ag.Queue = append(ag.Queue, AdminQueued{
+				ID:          p.Comm.Id(),
+				QueuedAt:    p.QueuedAt,
+				WaitSeconds: time.Since(p.QueuedAt).Seconds(),
+			})
+		}
+		list = append(list, ag)
+	}
+	sort.Sort(byUUID(list))
+	return list
+}
+
+type byUUID []AdminGame
+
+func (b byUUID) Len() int           { return len(b) }
+func (b byUUID) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byUUID) Less(i, j int) bool { return b[i].UUID < b[j].UUID }
+
+// AdminRooms lists the running rooms ordered by name
+func AdminRooms(info Control) []AdminRoom {
+	list := []AdminRoom{}
+	for _, r := range info.Rooms.All() {
+		_, version := r.State()
+		ar := AdminRoom{
+			Name:         r.Name,
+			GameID:       r.GameID,
+			CurrentTurn:  r.CurrentTurn(),
+			StateVersion: version,
+			Seats:        []AdminSeat{},
+			Spectators:   []string{},
+		}
+		for turn, p := range r.Seats() {
+			seat := AdminSeat{Turn: turn}
+			if p.Comm != nil {
+				seat.ID = p.Comm.Id()
+				rn, inRoom := info.RoomMap.Get(seat.ID)
+				seat.Connected = inRoom && rn == r.Name
+			}
+			ar.Seats = append(ar.Seats, seat)
+		}
+		for _, p := range r.Spectators() {
+			ar.Spectators = append(ar.Spectators, p.Comm.Id())
+		}
+		list = append(list, ar)
+	}
+	return list
+}
+
+// KickPlayer removes the player with the given id from the lobby, private
+// room or room they are in, or the room they are spectating, and tells them
+// why. Their seat is given up for good just as if they had left the room. It
+// returns false if the player was not waiting or playing anywhere.
+func KickPlayer(id, reason string, games *domain.GameStore, info Control) bool {
+	found := false
+	if _, ok := DequeuePlayer(id, games, info); ok {
+		found = true
+	}
+	if _, ok := StopSpectating(id, info); ok {
+		found = true
+	}
+	if pr, ok := info.PrivateRooms.Remove(id); ok {
+		EmitPrivateRoomUpdate(pr)
+		found = true
+	}
+	if rn, turn, ok := RemoveFromRoom(id, info); ok {
+		if room, exists := info.Rooms.Get(rn); exists {
+			if p := room.Seats()[turn]; p.Comm != nil {
+				p.Comm.Leave(rn)
+			}
+		}
+		info.Sessions.Remove(id)
+		m := map[string]interface{}{}
+		m["player"] = turn
+		info.Broadcaster.BroadcastTo(rn, playerLeft, WrapResponse(playerLeft, m))
+		ReleaseSeat(rn, turn, info)
+		found = true
+	}
+	if found {
+		log.Println("Kicked", id, "because of", reason)
+		data := map[string]interface{}{}
+		data["reason"] = reason
+		info.Broadcaster.BroadcastTo(id, kicked, WrapResponse(kicked, data))
+	}
+	return found
+}
+
+// adminServer serves the admin API under /admin/. Every request must carry
+// the admin token in an "Authorization: Bearer <token>" header.
+type adminServer struct {
+	Token string
+	Games *domain.GameStore
+	Info  Control
+}
+
+func (s adminServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	auth := []byte(r.Header.Get("Authorization"))
+	if subtle.ConstantTimeCompare(auth, []byte("Bearer "+s.Token)) != 1 {
+		writeAdminError(w, http.StatusUnauthorized, "Invalid admin token")
+		return
+	}
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin"), "/")
+	parts := strings.Split(path, "/")
+	switch {
+	case r.Method == "GET" && path == "games":
+		writeAdminJSON(w, http.StatusOK, AdminGames(s.Games, s.Info))
+	case r.Method == "GET" && path == "rooms":
+		writeAdminJSON(w, http.StatusOK, AdminRooms(s.Info))
+	case r.Method == "POST" && len(parts) == 3 && parts[0] == "rooms" &&
+		parts[2] == "close":
+		if _, exists := s.Info.Rooms.Get(parts[1]); !exists {
+			writeAdminError(w, http.StatusNotFound, "No room with that name")
+			return
+		}
+		CloseRoom(parts[1], adminReason(r, "Closed by an administrator"), s.Info)
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == "POST" && len(parts) == 3 && parts[0] == "players" &&
+		parts[2] == "kick":
+		reason := adminReason(r, "Removed by an administrator")
+		if !KickPlayer(parts[1], reason, s.Games, s.Info) {
+			writeAdminError(w, http.StatusNotFound, "Player is not in any queue or room")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeAdminError(w, http.StatusNotFound, "Unknown admin endpoint")
+	}
+}
+
+// adminReason returns the reason given in the request's query or the default
+func adminReason(r *http.Request, def string) string {
+	if reason := r.URL.Query().Get("reason"); reason != "" {
+		return reason
+	}
+	return def
+}
+
+func writeAdminJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeAdminError(w http.ResponseWriter, status int, err string) {
+	d := map[string]interface{}{}
+	d["error"] = err
+	writeAdminJSON(w, status, d)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/googollee/go-socket.io"
+	"github.com/tiltfactor/toto/utils"
+)
+
+// ErrNoToken is returned when a connection doesn't include a token
+var ErrNoToken = errors.New("Must include token")
+
+// Authenticator verifies the token that clients send in the token query
+// parameter of the socket.io handshake. Tokens are JWTs signed with HS256
+// using the secret and their subject is the id of the user.
+type Authenticator struct {
+	Secret []byte
+}
+
+// Authenticate returns the claims of the request's token if it is valid
+func (a *Authenticator) Authenticate(r *http.Request) (utils.Claims, error) {
+	if r == nil {
+		return utils.Claims{}, ErrNoToken
+	}
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		return utils.Claims{}, ErrNoToken
+	}
+	return utils.VerifyToken(token, a.Secret, time.Now())
+}
+
+// AllowRequest refuses the socket.io handshake of clients without a valid
+// token, it is meant for socketio.Server.SetAllowRequest.
+func (a *Authenticator) AllowRequest(r *http.Request) error {
+	_, err := a.Authenticate(r)
+	return err
+}
+
+// PublicID returns the id the socket's player is shown to others by.
+// Authenticated players are known by their user id rather than by their
+// socket which changes with every connection.
+func PublicID(so socketio.Socket, info Control) string {
+	if userID, ok := info.Users.Get(so.Id()); ok {
+		return userID
+	}
+	return so.Id()
+}
+
+// AuthenticateSocket verifies the token of a new socket when auth is on and
+// records the id of its user. It emits a client error and returns false if
+// the token is not valid, in which case the socket should be ignored.
+func AuthenticateSocket(so socketio.Socket, info Control) bool {
+	if info.Auth == nil {
+		return true
+	}
+	c, err := info.Auth.Authenticate(so.Request())
+	if err != nil {
+		log.Debug("Rejected connection from", so.Id(), err)
+		so.Emit(clientError, ErrorResponse(clientError, "Unauthorized: "+err.Error()))
+		return false
+	}
+	info.Users.Set(so.Id(), c.Subject)
+	log.Debug(so.Id(), "authenticated as", c.Subject)
+	return true
+}
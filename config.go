@@ -0,0 +1,320 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/Sirupsen/logrus"
+	"github.com/codegangsta/cli"
+)
+
+// The file the server reads its config from unless --config says otherwise
+const defaultConfigFile = "toto.toml"
+
+// Config is the server config. It is read from toto.toml and then overridden
+// by environment variables and flags, in that order.
+type Config struct {
+	// The address to listen on, such as :3000 or 127.0.0.1:8080
+	Listen           string `toml:"listen"`
+	GamesDir         string `toml:"gamesDir"`
+	StaticDir        string `toml:"staticDir"`
+	MaxMessageLength int    `toml:"maxMessageLength"`
+
+	Log      LogConfig      `toml:"log"`
+	CORS     CORSConfig     `toml:"cors"`
+	TLS      TLSSettings    `toml:"tls"`
+	Timeouts TimeoutsConfig `toml:"timeouts"`
+	Features FeaturesConfig `toml:"features"`
+}
+
+// LogConfig sets how the server logs
+type LogConfig struct {
+	// One of panic, fatal, error, warn, info or debug
+	Level string `toml:"level"`
+	// Either text or json
+	Format string `toml:"format"`
+}
+
+// CORSConfig sets the origins allowed to connect from other sites
+type CORSConfig struct {
+	Origins []string `toml:"origins"`
+	Dev     bool     `toml:"dev"`
+}
+
+// TLSSettings sets how HTTPS is served, it is served when a certificate is
+// given or self-signed is set.
+type TLSSettings struct {
+	Cert         string `toml:"cert"`
+	Key          string `toml:"key"`
+	SelfSigned   bool   `toml:"selfSigned"`
+	RedirectPort string `toml:"redirectPort"`
+}
+
+// TimeoutsConfig holds the server's timeouts, written as durations such as
+// "30s" or "1m30s".
+type TimeoutsConfig struct {
+	ReconnectGrace duration `toml:"reconnectGrace"`
+	ReloadInterval duration `toml:"reloadInterval"`
+	// How long rooms have to finish once the server is asked to shut down
+	ShutdownGrace duration `toml:"shutdownGrace"`
+}
+
+// FeaturesConfig turns on the optional parts of the server, each of them is
+// off when left empty.
+type FeaturesConfig struct {
+	Metrics     bool   `toml:"metrics"`
+	AdminToken  string `toml:"adminToken"`
+	AuthSecret  string `toml:"authSecret"`
+	RecordDir   string `toml:"recordDir"`
+	PlayersFile string `toml:"playersFile"`
+	RatingsFile string `toml:"ratingsFile"`
+}
+
+// duration is a time.Duration that is written in toml as a string
+type duration struct {
+	time.Duration
+}
+
+// UnmarshalText parses durations such as "30s"
+func (d *duration) UnmarshalText(text []byte) error {
+	var err error
+	d.Duration, err = time.ParseDuration(string(text))
+	return err
+}
+
+// MarshalText writes the duration the way UnmarshalText reads it
+func (d duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+// DefaultConfig returns the config the server runs with when nothing is set
+func DefaultConfig() Config {
+	return Config{
+		Listen:           ":3000",
+		GamesDir:         "./games",
+		StaticDir:        "./asset",
+		MaxMessageLength: 500,
+		Log:              LogConfig{Level: "debug", Format: "text"},
+		Timeouts: TimeoutsConfig{
+			ReconnectGrace: duration{30 * time.Second},
+			ReloadInterval: duration{2 * time.Second},
+			ShutdownGrace:  duration{30 * time.Second},
+		},
+	}
+}
+
+// Port returns the port part of the listen address
+func (cfg Config) Port() string {
+	_, port, err := net.SplitHostPort(cfg.Listen)
+	if err != nil {
+		return ""
+	}
+	return port
+}
+
+// Redacted returns a copy of the config with its secrets hidden so that it
+// can be shown.
+func (cfg Config) Redacted() Config {
+	if cfg.Features.AdminToken != "" {
+		cfg.Features.AdminToken = "[redacted]"
+	}
+	if cfg.Features.AuthSecret != "" {
+		cfg.Features.AuthSecret = "[redacted]"
+	}
+	return cfg
+}
+
+// ReadConfigFile reads the config file over the config. Unknown keys are
+// returned so that they can be reported, as they are most likely typos.
+func ReadConfigFile(path string, cfg *Config) ([]string, error) {
+	md, err := toml.DecodeFile(path, cfg)
+	if err != nil {
+		return nil, err
+	}
+	unknown := []string{}
+	for _, key := range md.Undecoded() {
+		unknown = append(unknown, key.String())
+	}
+	return unknown, nil
+}
+
+// LoadConfig returns the effective config: the defaults, overridden by the
+// config file, overridden by environment variables and flags. The config file
+// may be missing unless it was given with --config.
+func LoadConfig(c *cli.Context) (Config, error) {
+	cfg := DefaultConfig()
+	o := newOverrides(c)
+	path := defaultConfigFile
+	o.str(&path, "config")
+	unknown, err := ReadConfigFile(path, &cfg)
+	switch {
+	case os.IsNotExist(err) && !o.set("config"):
+	case err != nil:
+		return cfg, err
+	default:
+		for _, key := range unknown {
+			log.Warn(path, ": unknown key ", key)
+		}
+	}
+
+	o.str(&cfg.Listen, "listen")
+	if o.set("port") {
+		host, _, err := net.SplitHostPort(cfg.Listen)
+		if err != nil {
+			return cfg, errors.New("Invalid listen address: " + cfg.Listen)
+		}
+		cfg.Listen = net.JoinHostPort(host, c.GlobalString("port"))
+	}
+	o.str(&cfg.GamesDir, "games-dir")
+	o.str(&cfg.StaticDir, "static-dir")
+	o.integer(&cfg.MaxMessageLength, "max-message-length")
+	o.str(&cfg.Log.Level, "log-level")
+	o.str(&cfg.Log.Format, "log-format")
+	if o.set("cors-origins") {
+		cfg.CORS.Origins = strings.Split(c.GlobalString("cors-origins"), ",")
+	}
+	o.boolean(&cfg.CORS.Dev, "cors-dev")
+	o.str(&cfg.TLS.Cert, "tls-cert")
+	o.str(&cfg.TLS.Key, "tls-key")
+	o.boolean(&cfg.TLS.SelfSigned, "tls-self-signed")
+	o.str(&cfg.TLS.RedirectPort, "redirect-port")
+	o.duration(&cfg.Timeouts.ReconnectGrace, "reconnect-grace")
+	o.duration(&cfg.Timeouts.ReloadInterval, "reload-interval")
+	o.duration(&cfg.Timeouts.ShutdownGrace, "shutdown-grace")
+	o.boolean(&cfg.Features.Metrics, "metrics")
+	o.str(&cfg.Features.AdminToken, "admin-token")
+	o.str(&cfg.Features.AuthSecret, "auth-secret")
+	o.str(&cfg.Features.RecordDir, "record-dir")
+	o.str(&cfg.Features.PlayersFile, "players-file")
+	o.str(&cfg.Features.RatingsFile, "ratings-file")
+
+	return cfg, cfg.Validate()
+}
+
+// Validate checks the values that the server can't run with
+func (cfg *Config) Validate() error {
+	if _, _, err := net.SplitHostPort(cfg.Listen); err != nil {
+		return errors.New("Invalid listen address: " + cfg.Listen)
+	}
+	if _, err := logrus.ParseLevel(cfg.Log.Level); err != nil {
+		return err
+	}
+	if cfg.Log.Format != "text" && cfg.Log.Format != "json" {
+		return errors.New("Log format must be text or json, not " + cfg.Log.Format)
+	}
+	origins, err := ParseOrigins(strings.Join(cfg.CORS.Origins, ","))
+	if err != nil {
+		return err
+	}
+	cfg.CORS.Origins = origins
+	if cfg.TLS.RedirectPort != "" && cfg.TLS.Cert == "" && !cfg.TLS.SelfSigned {
+		return errors.New("redirectPort needs TLS, set a certificate or selfSigned")
+	}
+	if cfg.MaxMessageLength <= 0 {
+		return errors.New("maxMessageLength must be positive")
+	}
+	if cfg.Timeouts.ReconnectGrace.Duration < 0 || cfg.Timeouts.ReloadInterval.Duration < 0 ||
+		cfg.Timeouts.ShutdownGrace.Duration < 0 {
+		return errors.New("Timeouts can't be negative")
+	}
+	return nil
+}
+
+// ConfigureLogging sets the logger's level and format
+func ConfigureLogging(l LogConfig) {
+	level, err := logrus.ParseLevel(l.Level)
+	if err == nil {
+		log.Level = level
+	}
+	if l.Format == "json" {
+		log.Formatter = &logrus.JSONFormatter{}
+	} else {
+		log.Formatter = &logrus.TextFormatter{FullTimestamp: true}
+	}
+}
+
+// PrintConfig writes the effective config to stdout as toml, with its secrets
+// redacted.
+func PrintConfig(c *cli.Context) {
+	cfg, err := LoadConfig(c)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := toml.NewEncoder(os.Stdout).Encode(cfg.Redacted()); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// overrides tells which of the global flags were set, either on the command
+// line or through their environment variable, and copies their values over the
+// config's.
+type overrides struct {
+	c *cli.Context
+	// The environment variables of each flag by name
+	env map[string]string
+}
+
+// newOverrides looks up the environment variables of the app's flags
+func newOverrides(c *cli.Context) overrides {
+	root := c
+	for root.Parent() != nil {
+		root = root.Parent()
+	}
+	o := overrides{c: c, env: map[string]string{}}
+	for _, f := range root.App.Flags {
+		var name, env string
+		switch f := f.(type) {
+		case cli.StringFlag:
+			name, env = f.Name, f.EnvVar
+		case cli.BoolFlag:
+			name, env = f.Name, f.EnvVar
+		case cli.IntFlag:
+			name, env = f.Name, f.EnvVar
+		case cli.DurationFlag:
+			name, env = f.Name, f.EnvVar
+		}
+		o.env[strings.TrimSpace(strings.Split(name, ",")[0])] = env
+	}
+	return o
+}
+
+// set returns true if the flag was given or its environment variable is set
+func (o overrides) set(name string) bool {
+	if o.c.GlobalIsSet(name) {
+		return true
+	}
+	for _, env := range strings.Split(o.env[name], ",") {
+		if env = strings.TrimSpace(env); env != "" && os.Getenv(env) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func (o overrides) str(dst *string, name string) {
+	if o.set(name) {
+		*dst = o.c.GlobalString(name)
+	}
+}
+
+func (o overrides) boolean(dst *bool, name string) {
+	if o.set(name) {
+		*dst = o.c.GlobalBool(name)
+	}
+}
+
+func (o overrides) integer(dst *int, name string) {
+	if o.set(name) {
+		*dst = o.c.GlobalInt(name)
+	}
+}
+
+func (o overrides) duration(dst *duration, name string) {
+	if o.set(name) {
+		dst.Duration = o.c.GlobalDuration(name)
+	}
+}
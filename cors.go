@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/codegangsta/cli"
+)
+
+// corsServer adds cross-origin request capabilities to the handler it wraps,
+// the socket.io server, for the origins that are allowed. Requests from other
+// origins are refused with a 403 while requests without an Origin header and
+// same-origin requests are always let through.
+type corsServer struct {
+	Handler http.Handler
+	// Exact origins such as https://example.com or wildcards such as
+	// https://*.example.com, which match any subdomain but not the domain
+	Origins []string
+	// Allows every origin, only meant for development
+	AllowAll bool
+}
+
+// ServeHTTP is implemented to add the needed header for CORS in socketio.
+// Preflight requests are answered directly rather than being passed on.
+func (s corsServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	origin := r.Header.Get("Origin")
+	if origin == "" || sameOrigin(origin, r) {
+		s.Handler.ServeHTTP(w, r)
+		return
+	}
+	if !s.AllowAll && !originAllowed(origin, s.Origins) {
+		log.Debug("Refused request from origin", origin)
+		http.Error(w, "Origin not allowed", http.StatusForbidden)
+		return
+	}
+	h := w.Header()
+	h.Set("Access-Control-Allow-Origin", origin)
+	h.Set("Access-Control-Allow-Credentials", "true")
+	h.Add("Vary", "Origin")
+	if r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != "" {
+		h.Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+		if headers := r.Header.Get("Access-Control-Request-Headers"); headers != "" {
+			h.Set("Access-Control-Allow-Headers", headers)
+		}
+		h.Set("Access-Control-Max-Age", "600")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	s.Handler.ServeHTTP(w, r)
+}
+
+// sameOrigin returns true if the origin is the host the request was sent to
+func sameOrigin(origin string, r *http.Request) bool {
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == r.Host
+}
+
+// originAllowed returns true if the origin matches one of the allowed origins
+func originAllowed(origin string, allowed []string) bool {
+	for _, a := range allowed {
+		if a == origin {
+			return true
+		}
+		i := strings.Index(a, "://*.")
+		if i < 0 {
+			continue
+		}
+		scheme, domain := a[:i+3], a[i+4:]
+		if !strings.HasPrefix(origin, scheme) || !strings.HasSuffix(origin, domain) {
+			continue
+		}
+		sub := origin[len(scheme) : len(origin)-len(domain)]
+		if sub != "" && !strings.ContainsAny(sub, "/:@") {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseOrigins splits a comma separated list of allowed origins, checking
+// that each one is a scheme and host with an optional port, and that
+// wildcards only stand for the subdomains of a host.
+func ParseOrigins(list string) ([]string, error) {
+	origins := []string{}
+	for _, o := range strings.Split(list, ",") {
+		o = strings.TrimSpace(o)
+		if o == "" {
+			continue
+		}
+		u, err := url.Parse(strings.Replace(o, "://*.", "://", 1))
+		if err != nil || u.Scheme == "" || u.Host == "" ||
+			(u.Path != "" && u.Path != "/") || u.RawQuery != "" ||
+			u.Fragment != "" || u.User != nil || strings.Contains(u.Host, "*") {
+			return nil, errors.New("Invalid origin: " + o)
+		}
+		origins = append(origins, strings.TrimSuffix(o, "/"))
+	}
+	return origins, nil
+}
+
+// corsFlags are the flags of every command that serves socket.io
+var corsFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:   "cors-origins",
+		Usage:  "Comma separated origins allowed to connect from other sites, such as https://example.com or https://*.example.com",
+		EnvVar: "TOTO_CORS_ORIGINS",
+	},
+	cli.BoolFlag{
+		Name:   "cors-dev",
+		Usage:  "Allows every origin to connect, only meant for development",
+		EnvVar: "TOTO_CORS_DEV",
+	},
+}
+
+// newCORSServer wraps the handler in a corsServer allowing the origins, or
+// every origin when allowAll is set.
+func newCORSServer(h http.Handler, origins []string, allowAll bool) corsServer {
+	if allowAll {
+		log.Warn("Every origin is allowed to connect, this is only meant for development")
+	}
+	return corsServer{Handler: h, Origins: origins, AllowAll: allowAll}
+}
+
+// corsFromFlags wraps the handler in a corsServer set up from the cors flags
+func corsFromFlags(c *cli.Context, h http.Handler) corsServer {
+	origins, err := ParseOrigins(c.String("cors-origins"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	return newCORSServer(h, origins, c.Bool("cors-dev"))
+}
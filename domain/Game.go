@@ -1,14 +1,154 @@
 package domain
 
+import (
+	"sync"
+	"time"
+
+	"github.com/tiltfactor/toto/utils"
+)
+
 // GameMap serves as an in memory store of the different registered games
 type GameMap map[string]Game
 
+// GameStore is a threadsafe GameMap, it allows the games to be reloaded while
+// the server is running.
+type GameStore struct {
+	Protect *sync.RWMutex
+	data    GameMap
+}
+
+// NewGameStore instantiates a new game store holding the given games
+func NewGameStore(gm GameMap) *GameStore {
+	data := GameMap{}
+	for key, g := range gm {
+		data[key] = g
+	}
+	return &GameStore{
+		Protect: &sync.RWMutex{},
+		data:    data,
+	}
+}
+
+// Get returns the game with the given unique key, retired or not
+func (gs *GameStore) Get(id string) (Game, bool) {
+	gs.Protect.RLock()
+	defer gs.Protect.RUnlock()
+	g, exists := gs.data[id]
+	return g, exists
+}
+
+// Playable returns the game with the given unique key as long as it has not
+// been retired, that is as long as players may still join it.
+func (gs *GameStore) Playable(id string) (Game, bool) {
+	g, exists := gs.Get(id)
+	return g, exists && !g.Retired
+}
+
+// All returns a copy of every stored game
+func (gs *GameStore) All() GameMap {
+	gs.Protect.RLock()
+	defer gs.Protect.RUnlock()
+	gm := GameMap{}
+	for key, g := range gs.data {
+		gm[key] = g
+	}
+	return gm
+}
+
+// Set stores the game under its unique key
+func (gs *GameStore) Set(g Game) {
+	gs.Protect.Lock()
+	defer gs.Protect.Unlock()
+	gs.data[g.UUID] = g
+}
+
+// Del deletes the game with the given unique key
+func (gs *GameStore) Del(id string) {
+	gs.Protect.Lock()
+	defer gs.Protect.Unlock()
+	delete(gs.data, id)
+}
+
 // Game contains all of our registered game information
 type Game struct {
-	FileName   string `toml:"-"`
-	Lobby      *Lobby
-	MinPlayers int    `toml:"minPlayers"`
-	MaxPlayers int    `toml:"maxPlayers"`
-	Title      string `toml:"displayTitle"`
-	UUID       string `toml:"uniqueKey"`
+	FileName           string `toml:"-"`
+	Lobby              *Lobby
+	MoveValidator      *utils.Schema `toml:"-"`
+	Retired            bool          `toml:"-"`
+	MinPlayers         int           `toml:"minPlayers"`
+	MaxPlayers         int           `toml:"maxPlayers"`
+	FillTimeout        int           `toml:"fillTimeout"`
+	TurnMode           string        `toml:"turnMode"`
+	TurnTimeoutSeconds int           `toml:"turnTimeoutSeconds"`
+	TurnTimeoutPolicy  string        `toml:"turnTimeoutPolicy"`
+	MoveSchema         string        `toml:"moveSchema"`
+	ReadyCheckSeconds  int           `toml:"readyCheckSeconds"`
+	Teams              Teams         `toml:"teams"`
+	DisableSpectators  bool          `toml:"disableSpectators"`
+	MaxSpectators      int           `toml:"maxSpectators"`
+	Matchmaking        string        `toml:"matchmaking"`
+	RatingSpread       float64       `toml:"ratingSpread"`
+	RatingSpreadGrowth float64       `toml:"ratingSpreadGrowth"`
+	Title              string        `toml:"displayTitle"`
+	UUID               string        `toml:"uniqueKey"`
+}
+
+// Turn modes a game can be declared with
+const (
+	// TurnModeFree lets any player move at any time, it is the default.
+	TurnModeFree = ""
+	// TurnModeStrict only accepts moves from the player whose turn it is.
+	TurnModeStrict = "strict"
+)
+
+// Policies applied when a player runs out of time for their turn
+const (
+	// TimeoutPolicySkip passes the turn on to the next player, it is the default.
+	TimeoutPolicySkip = "skip"
+	// TimeoutPolicyEnd closes the room.
+	TimeoutPolicyEnd = "end"
+)
+
+// Defaults used by games with rating matchmaking that don't set them
+const (
+	DefaultRatingSpread       = 100
+	DefaultRatingSpreadGrowth = 10
+)
+
+// Rated returns true if the game groups players by rating
+func (g Game) Rated() bool {
+	return g.Matchmaking == MatchmakingRating
+}
+
+// Spread returns how far apart the ratings of a group may be once a player has
+// waited for the given time. It starts at RatingSpread and grows by
+// RatingSpreadGrowth every second.
+func (g Game) Spread(waited time.Duration) float64 {
+	spread := g.RatingSpread
+	if spread == 0 {
+		spread = DefaultRatingSpread
+	}
+	growth := g.RatingSpreadGrowth
+	if growth == 0 {
+		growth = DefaultRatingSpreadGrowth
+	}
+	return spread + growth*waited.Seconds()
+}
+
+// FillWait returns how long the oldest player in the Lobby waits for a group
+// of MaxPlayers before a smaller group is formed. Zero means it waits forever.
+func (g Game) FillWait() time.Duration {
+	return time.Duration(g.FillTimeout) * time.Second
+}
+
+// TurnTimeout returns how long a player has to make their move before the
+// turn times out. Zero means turns never time out.
+func (g Game) TurnTimeout() time.Duration {
+	return time.Duration(g.TurnTimeoutSeconds) * time.Second
+}
+
+// ReadyCheck returns how long the players of a group have to be ready before
+// the group is broken up. Zero means groups are seated without a ready check.
+func (g Game) ReadyCheck() time.Duration {
+	return time.Duration(g.ReadyCheckSeconds) * time.Second
 }
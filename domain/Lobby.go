@@ -1,48 +1,277 @@
 package domain
 
-import "sync"
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
 
 // Lobby is basically a FIFO queue that is threadsafe through the usage of mutex
 // it uses a slice as the data store and a string to bool map to keep of track
-// of items in the queue
+// of items in the queue. Each item is a player or a party of players that
+// queued together, whose players are always grouped together.
 type Lobby struct {
 	Protect  *sync.RWMutex
-	data     []Player
+	data     []entry
 	contains map[string]bool
+	size     int
 }
 
+// entry is a player, or the players of a party, queued as a single item
+type entry []Player
+
 // NewLobby instantiates a new lobby (queue)
 func NewLobby() *Lobby {
 	return &Lobby{
 		Protect:  &sync.RWMutex{},
-		data:     []Player{},
+		data:     []entry{},
 		contains: make(map[string]bool),
 	}
 }
 
 // AddToQueue adds a player to the queue
 func (l *Lobby) AddToQueue(p Player) {
+	l.AddPartyToQueue([]Player{p})
+}
+
+// AddPartyToQueue adds the players to the queue as a single item so that they
+// are grouped together.
+func (l *Lobby) AddPartyToQueue(players []Player) {
 	l.Protect.Lock()
 	defer l.Protect.Unlock()
-	l.data = append(l.data, p)
-	l.contains[p.Comm.Id()] = true
+	now := time.Now()
+	e := make(entry, len(players))
+	for i, p := range players {
+		p.QueuedAt = now
+		e[i] = p
+	}
+	l.push(e)
+	l.data = append(l.data, e)
 }
 
-// PopFromQueue returns a player from the queue: FIFO
+// PopFromQueue returns the oldest player from the queue: FIFO
 func (l *Lobby) PopFromQueue() Player {
 	l.Protect.Lock()
 	defer l.Protect.Unlock()
-	item, a := l.data[0], l.data[1:]
-	l.data = a
-	delete(l.contains, item.Comm.Id())
+	item := l.data[0][0]
+	l.remove(item.Comm.Id())
 	return item
 }
 
-// Size returns the number of items in the q
+// PopGroup pops a group of max players from the queue if there are enough of
+// them. If there are not but the oldest player has been waiting for at least
+// fillWait, then as many players as possible are popped as long as that makes
+// at least min players. A fillWait of zero means groups are only formed at max.
+// Parties are never split and older items are always preferred.
+// It returns nil if no group could be formed.
+func (l *Lobby) PopGroup(min, max int, fillWait time.Duration) []Player {
+	l.Protect.Lock()
+	defer l.Protect.Unlock()
+	if l.size < min {
+		return nil
+	}
+	picked := pick(l.data, max)
+	if picked == nil {
+		if fillWait <= 0 || time.Since(l.data[0][0].QueuedAt) < fillWait {
+			return nil
+		}
+		// Take the oldest items that fit.
+		n := 0
+		for i, e := range l.data {
+			if n+len(e) <= max {
+				picked = append(picked, i)
+				n += len(e)
+			}
+		}
+		if n < min {
+			return nil
+		}
+	}
+	return l.take(picked)
+}
+
+// PopRatedGroup pops a group of max players with close ratings. Each item is
+// tried in turn, oldest first, along with the items whose rating is within the
+// spread allowed for how long it has waited, closest first. Once an item has
+// waited for at least fillWait a group of at least min players is popped
+// instead if that is all there is within its spread. Parties are never split
+// and a party's rating is the average of its players'.
+// It returns nil if no group could be formed.
+func (l *Lobby) PopRatedGroup(min, max int, fillWait time.Duration,
+	spread func(waited time.Duration) float64) []Player {
+	l.Protect.Lock()
+	defer l.Protect.Unlock()
+	if l.size < min {
+		return nil
+	}
+	now := time.Now()
+	for a, anchor := range l.data {
+		if len(anchor) > max {
+			continue
+		}
+		waited := now.Sub(anchor[0].QueuedAt)
+		allowed := spread(waited)
+		near := byDistance{}
+		for i, e := range l.data {
+			d := math.Abs(e.rating() - anchor.rating())
+			if i != a && d <= allowed {
+				near = append(near, nearItem{index: i, distance: d})
+			}
+		}
+		sort.Stable(near)
+		candidates := make([]entry, len(near))
+		for i, n := range near {
+			candidates[i] = l.data[n.index]
+		}
+		picked := pick(candidates, max-len(anchor))
+		if picked == nil {
+			if fillWait <= 0 || waited < fillWait {
+				continue
+			}
+			// Take the closest items that fit.
+			n := len(anchor)
+			for i, e := range candidates {
+				if n+len(e) <= max {
+					picked = append(picked, i)
+					n += len(e)
+				}
+			}
+			if n < min {
+				continue
+			}
+		}
+		indexes := []int{a}
+		for _, i := range picked {
+			indexes = append(indexes, near[i].index)
+		}
+		sort.Ints(indexes)
+		return l.take(indexes)
+	}
+	return nil
+}
+
+// rating returns the average rating of the item's players
+func (e entry) rating() float64 {
+	sum := 0.0
+	for _, p := range e {
+		sum += p.Rating
+	}
+	return sum / float64(len(e))
+}
+
+type nearItem struct {
+	index    int
+	distance float64
+}
+
+type byDistance []nearItem
+
+func (b byDistance) Len() int           { return len(b) }
+func (b byDistance) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byDistance) Less(i, j int) bool { return b[i].distance < b[j].distance }
+
+// pick returns the indexes of the first items that make exactly n players, or
+// nil if no combination of items does.
+func pick(items []entry, n int) []int {
+	// can[i][s] is true if the items from i on can make s players.
+	can := make([][]bool, len(items)+1)
+	for i := range can {
+		can[i] = make([]bool, n+1)
+	}
+	can[len(items)][0] = true
+	for i := len(items) - 1; i >= 0; i-- {
+		for s := 0; s <= n; s++ {
+			size := len(items[i])
+			can[i][s] = can[i+1][s] || (size <= s && can[i+1][s-size])
+		}
+	}
+	if !can[0][n] {
+		return nil
+	}
+	picked := []int{}
+	for i, e := range items {
+		if n == 0 {
+			break
+		}
+		if len(e) <= n && can[i+1][n-len(e)] {
+			picked = append(picked, i)
+			n -= len(e)
+		}
+	}
+	return picked
+}
+
+// take removes the items with the given indexes, which must be in order, and
+// returns their players. It must be called with the lock held.
+func (l *Lobby) take(picked []int) []Player {
+	group := []Player{}
+	rest := []entry{}
+	for i, e := range l.data {
+		if len(picked) > 0 && picked[0] == i {
+			picked = picked[1:]
+			group = append(group, e...)
+			continue
+		}
+		rest = append(rest, e)
+	}
+	l.data = rest
+	for _, p := range group {
+		delete(l.contains, p.Comm.Id())
+	}
+	l.size -= len(group)
+	return group
+}
+
+// Requeue puts the players back at the front of the queue in the order they
+// are given, keeping the time they were first queued at. Players of the same
+// party are put back as a single item. Players that are already queued are
+// left where they are.
+func (l *Lobby) Requeue(players []Player) {
+	l.Protect.Lock()
+	defer l.Protect.Unlock()
+	front := []entry{}
+	parties := map[string]int{}
+	for _, p := range players {
+		if l.contains[p.Comm.Id()] {
+			continue
+		}
+		if at, exists := parties[p.Party]; exists && p.Party != "" {
+			front[at] = append(front[at], p)
+		} else {
+			parties[p.Party] = len(front)
+			front = append(front, entry{p})
+		}
+	}
+	for _, e := range front {
+		l.push(e)
+	}
+	l.data = append(front, l.data...)
+}
+
+// Drain empties the queue and returns every player that was in it: FIFO
+func (l *Lobby) Drain() []Player {
+	l.Protect.Lock()
+	defer l.Protect.Unlock()
+	players := l.players()
+	l.data = []entry{}
+	l.contains = make(map[string]bool)
+	l.size = 0
+	return players
+}
+
+// Size returns the number of players in the q
 func (l *Lobby) Size() int {
 	l.Protect.Lock()
 	defer l.Protect.Unlock()
-	return len(l.data)
+	return l.size
+}
+
+// Queued returns a copy of the players waiting in the queue: FIFO
+func (l *Lobby) Queued() []Player {
+	l.Protect.RLock()
+	defer l.Protect.RUnlock()
+	return l.players()
 }
 
 // Contains returns true if the q contains the player with the given id
@@ -53,16 +282,51 @@ func (l *Lobby) Contains(id string) bool {
 	return exists
 }
 
-// Remove removes the player with the specified id
-func (l *Lobby) Remove(id string) {
+// Remove removes the player with the specified id, it returns true if the
+// player was in the queue. The rest of their party stays queued.
+func (l *Lobby) Remove(id string) bool {
 	l.Protect.Lock()
 	defer l.Protect.Unlock()
+	return l.remove(id)
+}
 
+// push records the players of the entry as queued. It must be called with the
+// lock held.
+func (l *Lobby) push(e entry) {
+	for _, p := range e {
+		l.contains[p.Comm.Id()] = true
+	}
+	l.size += len(e)
+}
+
+// remove must be called with the lock held
+func (l *Lobby) remove(id string) bool {
+	if !l.contains[id] {
+		return false
+	}
+	delete(l.contains, id)
+	l.size--
 	b := l.data[:0]
-	for _, x := range l.data {
-		if x.Comm.Id() != id {
-			b = append(b, x)
+	for _, e := range l.data {
+		kept := e[:0]
+		for _, p := range e {
+			if p.Comm.Id() != id {
+				kept = append(kept, p)
+			}
+		}
+		if len(kept) > 0 {
+			b = append(b, kept)
 		}
 	}
 	l.data = b
+	return true
+}
+
+// players must be called with the lock held
+func (l *Lobby) players() []Player {
+	players := []Player{}
+	for _, e := range l.data {
+		players = append(players, e...)
+	}
+	return players
 }
@@ -0,0 +1,96 @@
+package domain
+
+import (
+	"sync"
+	"time"
+)
+
+// Match is a group of players popped from a Lobby that is only seated once
+// every one of them is ready. Players are kept in the order they were popped.
+type Match struct {
+	ID       string
+	GameID   string
+	Players  []Player
+	Ready    map[string]bool
+	Deadline time.Time
+}
+
+// MatchStore is a threadsafe store of the matches waiting for their players
+// to be ready, keyed by their id.
+type MatchStore struct {
+	Protect  *sync.RWMutex
+	data     map[string]*Match
+	byPlayer map[string]string
+}
+
+// NewMatchStore instantiates a new match store
+func NewMatchStore() *MatchStore {
+	return &MatchStore{
+		Protect:  &sync.RWMutex{},
+		data:     make(map[string]*Match),
+		byPlayer: make(map[string]string),
+	}
+}
+
+// Add stores the match with none of its players ready
+func (ms *MatchStore) Add(m Match) {
+	ms.Protect.Lock()
+	defer ms.Protect.Unlock()
+	m.Ready = make(map[string]bool)
+	ms.data[m.ID] = &m
+	for _, p := range m.Players {
+		ms.byPlayer[p.Comm.Id()] = m.ID
+	}
+}
+
+// ByPlayer returns a copy of the match the player is in
+func (ms *MatchStore) ByPlayer(id string) (Match, bool) {
+	ms.Protect.RLock()
+	defer ms.Protect.RUnlock()
+	matchID, exists := ms.byPlayer[id]
+	if !exists {
+		return Match{}, false
+	}
+	return ms.data[matchID].copy(), true
+}
+
+// SetReady marks the player as ready in their match. It returns a copy of the
+// match, whether every player is now ready and true if the player was in one.
+func (ms *MatchStore) SetReady(id string) (Match, bool, bool) {
+	ms.Protect.Lock()
+	defer ms.Protect.Unlock()
+	matchID, exists := ms.byPlayer[id]
+	if !exists {
+		return Match{}, false, false
+	}
+	m := ms.data[matchID]
+	m.Ready[id] = true
+	return m.copy(), len(m.Ready) == len(m.Players), true
+}
+
+// Take removes the match with the given id and returns it so that it can be
+// seated or cancelled. Only one caller gets a match that is taken at the same
+// time by several.
+func (ms *MatchStore) Take(id string) (Match, bool) {
+	ms.Protect.Lock()
+	defer ms.Protect.Unlock()
+	m, exists := ms.data[id]
+	if !exists {
+		return Match{}, false
+	}
+	for _, p := range m.Players {
+		delete(ms.byPlayer, p.Comm.Id())
+	}
+	delete(ms.data, id)
+	return m.copy(), true
+}
+
+func (m *Match) copy() Match {
+	c := *m
+	c.Players = append([]Player{}, m.Players...)
+	c.Ready = make(map[string]bool, len(m.Ready))
+	for id := range m.Ready {
+		c.Ready[id] = true
+	}
+	return c
+}
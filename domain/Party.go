@@ -0,0 +1,168 @@
+package domain
+
+import (
+	"errors"
+	"sync"
+)
+
+// Errors returned when managing parties
+var (
+	ErrNoSuchParty    = errors.New("No party with that id")
+	ErrNotInvited     = errors.New("You have not been invited to that party")
+	ErrAlreadyInParty = errors.New("Already in a party")
+	ErrNotPartyLeader = errors.New("Only the party leader can do that")
+)
+
+// Party is a group of players that queue together and are always placed in
+// the same room. Members are kept in the order they joined and the first one
+// is the leader.
+type Party struct {
+	ID      string
+	Leader  string
+	Members []Player
+	Invited map[string]bool
+}
+
+// PartyStore is a threadsafe store of parties keyed by their id
+type PartyStore struct {
+	Protect  *sync.RWMutex
+	data     map[string]*Party
+	byPlayer map[string]string
+}
+
+// NewPartyStore instantiates a new party store
+func NewPartyStore() *PartyStore {
+	return &PartyStore{
+		Protect:  &sync.RWMutex{},
+		data:     make(map[string]*Party),
+		byPlayer: make(map[string]string),
+	}
+}
+
+// Create stores a new party with the leader as its only member. It returns a
+// copy of the party.
+func (ps *PartyStore) Create(id string, leader Player) (Party, error) {
+	ps.Protect.Lock()
+	defer ps.Protect.Unlock()
+	if _, exists := ps.byPlayer[leader.Comm.Id()]; exists {
+		return Party{}, ErrAlreadyInParty
+	}
+	p := &Party{
+		ID:      id,
+		Leader:  leader.Comm.Id(),
+		Members: []Player{leader},
+		Invited: make(map[string]bool),
+	}
+	ps.data[id] = p
+	ps.byPlayer[leader.Comm.Id()] = id
+	return p.copy(), nil
+}
+
+// Invite allows the player with the given id to join the party led by the
+// leader. It returns a copy of the party.
+func (ps *PartyStore) Invite(leaderID, id string) (Party, error) {
+	ps.Protect.Lock()
+	defer ps.Protect.Unlock()
+	partyID, exists := ps.byPlayer[leaderID]
+	if !exists {
+		return Party{}, ErrNoSuchParty
+	}
+	p := ps.data[partyID]
+	if p.Leader != leaderID {
+		return Party{}, ErrNotPartyLeader
+	}
+	p.Invited[id] = true
+	return p.copy(), nil
+}
+
+// Join adds the player to the party with the given id as long as they were
+// invited to it. It returns a copy of the party after the join.
+func (ps *PartyStore) Join(partyID string, pl Player) (Party, error) {
+	ps.Protect.Lock()
+	defer ps.Protect.Unlock()
+	p, exists := ps.data[partyID]
+	if !exists {
+		return Party{}, ErrNoSuchParty
+	}
+	if _, exists := ps.byPlayer[pl.Comm.Id()]; exists {
+		return Party{}, ErrAlreadyInParty
+	}
+	if !p.Invited[pl.Comm.Id()] {
+		return Party{}, ErrNotInvited
+	}
+	delete(p.Invited, pl.Comm.Id())
+	p.Members = append(p.Members, pl)
+	ps.byPlayer[pl.Comm.Id()] = partyID
+	return p.copy(), nil
+}
+
+// ByID returns a copy of the party with the given id
+func (ps *PartyStore) ByID(partyID string) (Party, bool) {
+	ps.Protect.RLock()
+	defer ps.Protect.RUnlock()
+	p, exists := ps.data[partyID]
+	if !exists {
+		return Party{}, false
+	}
+	return p.copy(), true
+}
+
+// ByPlayer returns a copy of the party the player is a member of
+func (ps *PartyStore) ByPlayer(id string) (Party, bool) {
+	ps.Protect.RLock()
+	defer ps.Protect.RUnlock()
+	partyID, exists := ps.byPlayer[id]
+	if !exists {
+		return Party{}, false
+	}
+	return ps.data[partyID].copy(), true
+}
+
+// Remove removes the player with the specified id from their party. If the
+// leader leaves the next member to have joined becomes the leader and an empty
+// party is discarded. It returns a copy of the party after the removal and
+// true if the player was in one.
+func (ps *PartyStore) Remove(id string) (Party, bool) {
+	ps.Protect.Lock()
+	defer ps.Protect.Unlock()
+	partyID, exists := ps.byPlayer[id]
+	if !exists {
+		return Party{}, false
+	}
+	delete(ps.byPlayer, id)
+	p := ps.data[partyID]
+	b := p.Members[:0]
+	for _, x := range p.Members {
+		if x.Comm.Id() != id {
+			b = append(b, x)
+		}
+	}
+	p.Members = b
+	if len(p.Members) == 0 {
+		delete(ps.data, partyID)
+		return Party{ID: partyID}, true
+	}
+	if p.Leader == id {
+		p.Leader = p.Members[0].Comm.Id()
+	}
+	return p.copy(), true
+}
+
+// MemberIDs returns the ids of the members in the order they joined
+func (p Party) MemberIDs() []string {
+	ids := []string{}
+	for _, m := range p.Members {
+		ids = append(ids, m.Comm.Id())
+	}
+	return ids
+}
+
+func (p *Party) copy() Party {
+	c := *p
+	c.Members = append([]Player{}, p.Members...)
+	c.Invited = make(map[string]bool)
+	for id := range p.Invited {
+		c.Invited[id] = true
+	}
+	return c
+}
@@ -1,14 +1,41 @@
 package domain
 
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrNoSuchPlayer is returned when a PlayerStore has no profile for an id
+var ErrNoSuchPlayer = errors.New("No player with that id")
+
 // Player ..
 type Player struct {
 	Comm Comm
+	// The id of the user the player authenticated as, empty when auth is off
+	UserID string
+	// Who the player is across connections, empty until they identify
+	Profile Profile
+	// When the player was added to the Lobby they were last popped from
+	QueuedAt time.Time
+	// The id of the party the player queued with, empty if they queued alone
+	Party string
+	// The rating the player was queued with in a game with rating matchmaking
+	Rating float64
 }
 
 func (p Player) String() string {
 	return p.Comm.Id()
 }
 
+// Profile is what is kept about a player across connections. Metadata holds
+// whatever the client wants to keep about the player.
+type Profile struct {
+	ID          string                 `json:"id"`
+	DisplayName string                 `json:"displayName"`
+	Metadata    map[string]interface{} `json:"metadata,omitempty"`
+}
+
 // Comm provides an interface to communicate with the Player
 type Comm interface {
 	// Id returns the session id of socket.
@@ -27,8 +54,89 @@ type Comm interface {
 	BroadcastTo(room, event string, args ...interface{}) error
 }
 
-// PlayerStore ...
+// PlayerStore keeps player profiles keyed by their id. Only the profile of a
+// player is stored so the players it returns have no Comm. Implementations
+// must be threadsafe.
 type PlayerStore interface {
-	Store(p Player)
+	Store(p Player) error
 	Get(uuid string) (*Player, error)
 }
+
+// profileMap holds profiles by player id
+type profileMap map[string]Profile
+
+// MemoryPlayerStore is a PlayerStore that forgets every profile when the
+// server stops.
+type MemoryPlayerStore struct {
+	Protect *sync.RWMutex
+	data    profileMap
+}
+
+// NewMemoryPlayerStore instantiates a new in memory player store
+func NewMemoryPlayerStore() *MemoryPlayerStore {
+	return &MemoryPlayerStore{
+		Protect: &sync.RWMutex{},
+		data:    profileMap{},
+	}
+}
+
+// Store stores the player's profile under its id
+func (ms *MemoryPlayerStore) Store(p Player) error {
+	ms.Protect.Lock()
+	defer ms.Protect.Unlock()
+	ms.data[p.Profile.ID] = p.Profile
+	return nil
+}
+
+// Get returns the player with the given id
+func (ms *MemoryPlayerStore) Get(uuid string) (*Player, error) {
+	ms.Protect.RLock()
+	defer ms.Protect.RUnlock()
+	profile, exists := ms.data[uuid]
+	if !exists {
+		return nil, ErrNoSuchPlayer
+	}
+	return &Player{Profile: profile}, nil
+}
+
+// FilePlayerStore is a PlayerStore that keeps every profile in a JSON file, it
+// is rewritten whenever a profile changes.
+type FilePlayerStore struct {
+	File    string
+	Protect *sync.RWMutex
+	data    profileMap
+}
+
+// NewFilePlayerStore instantiates a new player store backed by the file,
+// loading the profiles it already holds. The file is created on the first
+// change if it doesn't exist.
+func NewFilePlayerStore(file string) (*FilePlayerStore, error) {
+	fs := &FilePlayerStore{
+		File:    file,
+		Protect: &sync.RWMutex{},
+		data:    profileMap{},
+	}
+	if err := readJSON(file, &fs.data); err != nil {
+		return nil, err
+	}
+	return fs, nil
+}
+
+// Store stores the player's profile under its id and rewrites the file
+func (fs *FilePlayerStore) Store(p Player) error {
+	fs.Protect.Lock()
+	defer fs.Protect.Unlock()
+	fs.data[p.Profile.ID] = p.Profile
+	return writeJSON(fs.File, fs.data)
+}
+
+// Get returns the player with the given id
+func (fs *FilePlayerStore) Get(uuid string) (*Player, error) {
+	fs.Protect.RLock()
+	defer fs.Protect.RUnlock()
+	profile, exists := fs.data[uuid]
+	if !exists {
+		return nil, ErrNoSuchPlayer
+	}
+	return &Player{Profile: profile}, nil
+}
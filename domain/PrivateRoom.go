@@ -0,0 +1,155 @@
+package domain
+
+import (
+	"errors"
+	"sort"
+	"sync"
+)
+
+// Errors returned when joining a private room
+var (
+	ErrNoSuchRoom = errors.New("No private room with that code")
+	ErrRoomFull   = errors.New("Private room is full")
+)
+
+// PrivateRoom is a room that players join by sharing its code rather than by
+// waiting in the game's Lobby. Players are kept in the order they joined and
+// the first one is the host.
+type PrivateRoom struct {
+	Code       string
+	GameID     string
+	Host       string
+	MinPlayers int
+	MaxPlayers int
+	Players    []Player
+}
+
+// PrivateRoomStore is a threadsafe store of the private rooms that are still
+// waiting for players, keyed by their code.
+type PrivateRoomStore struct {
+	Protect  *sync.RWMutex
+	data     map[string]*PrivateRoom
+	byPlayer map[string]string
+}
+
+// NewPrivateRoomStore instantiates a new private room store
+func NewPrivateRoomStore() *PrivateRoomStore {
+	return &PrivateRoomStore{
+		Protect:  &sync.RWMutex{},
+		data:     make(map[string]*PrivateRoom),
+		byPlayer: make(map[string]string),
+	}
+}
+
+// Create stores the private room with its host as the only player. It returns
+// false if the room's code is already taken.
+func (ps *PrivateRoomStore) Create(pr PrivateRoom, host Player) bool {
+	ps.Protect.Lock()
+	defer ps.Protect.Unlock()
+	if _, exists := ps.data[pr.Code]; exists {
+		return false
+	}
+	pr.Host = host.Comm.Id()
+	pr.Players = []Player{host}
+	ps.data[pr.Code] = &pr
+	ps.byPlayer[host.Comm.Id()] = pr.Code
+	return true
+}
+
+// Join adds the player to the private room with the given code as long as it
+// is not full. It returns a copy of the room after the join.
+func (ps *PrivateRoomStore) Join(code string, p Player) (PrivateRoom, error) {
+	ps.Protect.Lock()
+	defer ps.Protect.Unlock()
+	pr, exists := ps.data[code]
+	if !exists {
+		return PrivateRoom{}, ErrNoSuchRoom
+	}
+	if len(pr.Players) >= pr.MaxPlayers {
+		return PrivateRoom{}, ErrRoomFull
+	}
+	pr.Players = append(pr.Players, p)
+	ps.byPlayer[p.Comm.Id()] = code
+	return pr.copy(), nil
+}
+
+// ByPlayer returns a copy of the private room the player is waiting in
+func (ps *PrivateRoomStore) ByPlayer(id string) (PrivateRoom, bool) {
+	ps.Protect.RLock()
+	defer ps.Protect.RUnlock()
+	code, exists := ps.byPlayer[id]
+	if !exists {
+		return PrivateRoom{}, false
+	}
+	return ps.data[code].copy(), true
+}
+
+// All returns a copy of every private room that is waiting ordered by code
+func (ps *PrivateRoomStore) All() []PrivateRoom {
+	ps.Protect.RLock()
+	defer ps.Protect.RUnlock()
+	rooms := make([]PrivateRoom, 0, len(ps.data))
+	for _, pr := range ps.data {
+		rooms = append(rooms, pr.copy())
+	}
+	sort.Sort(byCode(rooms))
+	return rooms
+}
+
+type byCode []PrivateRoom
+
+func (b byCode) Len() int           { return len(b) }
+func (b byCode) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byCode) Less(i, j int) bool { return b[i].Code < b[j].Code }
+
+// Take removes the private room with the given code and returns it so that
+// its players can be placed in a real room.
+func (ps *PrivateRoomStore) Take(code string) (PrivateRoom, bool) {
+	ps.Protect.Lock()
+	defer ps.Protect.Unlock()
+	pr, exists := ps.data[code]
+	if !exists {
+		return PrivateRoom{}, false
+	}
+	for _, p := range pr.Players {
+		delete(ps.byPlayer, p.Comm.Id())
+	}
+	delete(ps.data, code)
+	return pr.copy(), true
+}
+
+// Remove removes the player with the specified id from the private room they
+// are waiting in. If the host leaves the next player to have joined becomes
+// the host and an empty room is discarded. It returns a copy of the room after
+// the removal and true if the player was in one.
+func (ps *PrivateRoomStore) Remove(id string) (PrivateRoom, bool) {
+	ps.Protect.Lock()
+	defer ps.Protect.Unlock()
+	code, exists := ps.byPlayer[id]
+	if !exists {
+		return PrivateRoom{}, false
+	}
+	delete(ps.byPlayer, id)
+	pr := ps.data[code]
+	b := pr.Players[:0]
+	for _, x := range pr.Players {
+		if x.Comm.Id() != id {
+			b = append(b, x)
+		}
+	}
+	pr.Players = b
+	if len(pr.Players) == 0 {
+		delete(ps.data, code)
+		return PrivateRoom{Code: code, GameID: pr.GameID}, true
+	}
+	if pr.Host == id {
+		pr.Host = pr.Players[0].Comm.Id()
+	}
+	return pr.copy(), true
+}
+
+func (pr *PrivateRoom) copy() PrivateRoom {
+	c := *pr
+	c.Players = append([]Player{}, pr.Players...)
+	return c
+}
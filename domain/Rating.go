@@ -0,0 +1,187 @@
+package domain
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Matchmaking modes a game can be declared with
+const (
+	// MatchmakingFIFO groups players in the order they queued, it is the
+	// default.
+	MatchmakingFIFO = ""
+	// MatchmakingRating groups players with close ratings.
+	MatchmakingRating = "rating"
+)
+
+// DefaultRating is the rating of players who have none yet
+const DefaultRating = 1500
+
+// EloK is how many points a rating moves by at most after a result
+const EloK = 32
+
+// RatingStore keeps the rating of each player for each game. Implementations
+// must be threadsafe.
+type RatingStore interface {
+	// Rating returns the rating of the player for the game and true if they
+	// have one.
+	Rating(gameID, playerID string) (float64, bool)
+	// SetRating stores the rating of the player for the game.
+	SetRating(gameID, playerID string, rating float64) error
+}
+
+// Elo returns the new ratings of the players of a game given their ratings
+// and their ranks, lower is better and equal ranks are a draw. Every player is
+// scored against each other player and the change is scaled so that no rating
+// moves by more than k.
+func Elo(ratings []float64, ranks []int, k float64) []float64 {
+	updated := append([]float64{}, ratings...)
+	if len(ratings) < 2 {
+		return updated
+	}
+	scale := k / float64(len(ratings)-1)
+	for i := range ratings {
+		delta := 0.0
+		for j := range ratings {
+			if i == j {
+				continue
+			}
+			expected := 1 / (1 + math.Pow(10, (ratings[j]-ratings[i])/400))
+			actual := 0.5
+			if ranks[i] < ranks[j] {
+				actual = 1
+			} else if ranks[i] > ranks[j] {
+				actual = 0
+			}
+			delta += actual - expected
+		}
+		updated[i] += scale * delta
+	}
+	return updated
+}
+
+// ratingMap holds ratings by game id then player id
+type ratingMap map[string]map[string]float64
+
+func (rm ratingMap) get(gameID, playerID string) (float64, bool) {
+	r, exists := rm[gameID][playerID]
+	return r, exists
+}
+
+func (rm ratingMap) set(gameID, playerID string, rating float64) {
+	if rm[gameID] == nil {
+		rm[gameID] = map[string]float64{}
+	}
+	rm[gameID][playerID] = rating
+}
+
+// MemoryRatingStore is a RatingStore that forgets every rating when the
+// server stops.
+type MemoryRatingStore struct {
+	Protect *sync.RWMutex
+	data    ratingMap
+}
+
+// NewMemoryRatingStore instantiates a new in memory rating store
+func NewMemoryRatingStore() *MemoryRatingStore {
+	return &MemoryRatingStore{
+		Protect: &sync.RWMutex{},
+		data:    ratingMap{},
+	}
+}
+
+// Rating returns the rating of the player for the game
+func (ms *MemoryRatingStore) Rating(gameID, playerID string) (float64, bool) {
+	ms.Protect.RLock()
+	defer ms.Protect.RUnlock()
+	return ms.data.get(gameID, playerID)
+}
+
+// SetRating stores the rating of the player for the game
+func (ms *MemoryRatingStore) SetRating(gameID, playerID string,
+	rating float64) error {
+	ms.Protect.Lock()
+	defer ms.Protect.Unlock()
+	ms.data.set(gameID, playerID, rating)
+	return nil
+}
+
+// FileRatingStore is a RatingStore that keeps every rating in a JSON file, it
+// is rewritten whenever a rating changes.
+type FileRatingStore struct {
+	File    string
+	Protect *sync.RWMutex
+	data    ratingMap
+}
+
+// NewFileRatingStore instantiates a new rating store backed by the file,
+// loading the ratings it already holds. The file is created on the first
+// change if it doesn't exist.
+func NewFileRatingStore(file string) (*FileRatingStore, error) {
+	fs := &FileRatingStore{
+		File:    file,
+		Protect: &sync.RWMutex{},
+		data:    ratingMap{},
+	}
+	if err := readJSON(file, &fs.data); err != nil {
+		return nil, err
+	}
+	return fs, nil
+}
+
+// Rating returns the rating of the player for the game
+func (fs *FileRatingStore) Rating(gameID, playerID string) (float64, bool) {
+	fs.Protect.RLock()
+	defer fs.Protect.RUnlock()
+	return fs.data.get(gameID, playerID)
+}
+
+// SetRating stores the rating of the player for the game and rewrites the
+// file.
+func (fs *FileRatingStore) SetRating(gameID, playerID string,
+	rating float64) error {
+	fs.Protect.Lock()
+	defer fs.Protect.Unlock()
+	fs.data.set(gameID, playerID, rating)
+	return writeJSON(fs.File, fs.data)
+}
+
+// readJSON decodes the JSON file into v, leaving v untouched if the file
+// doesn't exist.
+func readJSON(file string, v interface{}) error {
+	b, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// writeJSON replaces the file with v encoded as JSON. The file is replaced in
+// one go so that it is never left half written.
+func writeJSON(file string, v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(file), "."+filepath.Base(file))
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
@@ -0,0 +1,428 @@
+package domain
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/tiltfactor/toto/utils"
+)
+
+// Errors returned when spectating a room
+var (
+	ErrNoSpectators      = errors.New("Spectating is disabled for this game")
+	ErrTooManySpectators = errors.New("Room has too many spectators")
+	ErrAlreadySpectating = errors.New("Already spectating this room")
+)
+
+// Errors returned when reporting the result of a room
+var (
+	ErrResultReported = errors.New("A result was already reported")
+	ErrResultDisputed = errors.New("Ranks differ from the ones other players reported")
+)
+
+// Room holds what the server knows about a room once its players have been
+// seated. Seats are indexed by turn number and a seat whose player left for
+// good holds a Player without a Comm.
+type Room struct {
+	Name          string
+	GameID        string
+	TurnMode      string
+	TurnTimeout   time.Duration
+	TimeoutPolicy string
+	MoveValidator *utils.Schema
+	TeamCount     int
+	NoSpectators  bool
+	MaxSpectators int
+	Rated         bool
+	Protect       *sync.RWMutex
+	seats         []Player
+	seated        []Player
+	reported      bool
+	reports       map[int][]int
+	teams         []int
+	spectators    []Player
+	turn          int
+	timer         *time.Timer
+	timerSeq      int
+	closed        bool
+	state         map[string]interface{}
+	version       int
+}
+
+// NewRoom instantiates a new room for the game with the players seated in the
+// order they are given. Turn 0 is the first to play. If the game has teams the
+// players are split into them.
+func NewRoom(name string, g Game, players []Player) *Room {
+	return &Room{
+		Name:          name,
+		GameID:        g.UUID,
+		TurnMode:      g.TurnMode,
+		TurnTimeout:   g.TurnTimeout(),
+		TimeoutPolicy: g.TurnTimeoutPolicy,
+		MoveValidator: g.MoveValidator,
+		TeamCount:     g.Teams.Count,
+		NoSpectators:  g.DisableSpectators,
+		MaxSpectators: g.MaxSpectators,
+		Rated:         g.Rated(),
+		Protect:       &sync.RWMutex{},
+		seats:         append([]Player{}, players...),
+		seated:        append([]Player{}, players...),
+		reports:       map[int][]int{},
+		teams:         g.Teams.Assign(players),
+		state:         map[string]interface{}{},
+	}
+}
+
+// StrictTurns returns true if the server enforces the turn order of the room
+func (r *Room) StrictTurns() bool {
+	return r.TurnMode == TurnModeStrict
+}
+
+// Seats returns a copy of the room's seats indexed by turn number
+func (r *Room) Seats() []Player {
+	r.Protect.RLock()
+	defer r.Protect.RUnlock()
+	return append([]Player{}, r.seats...)
+}
+
+// Rebind seats a new player in the seat of the given turn
+func (r *Room) Rebind(turn int, p Player) {
+	r.Protect.Lock()
+	defer r.Protect.Unlock()
+	if turn >= 0 && turn < len(r.seats) {
+		r.seats[turn] = p
+	}
+}
+
+// ReportResult records the ranks reported by the player of the given turn. A
+// result only counts once every player still seated has reported the same
+// ranks, then the players as they were first seated are returned indexed by
+// turn number so that the result can be applied to them. It returns false
+// while some players have yet to report, and an error if a result was already
+// applied since a room only has one or if the ranks differ from the ones
+// reported before.
+func (r *Room) ReportResult(turn int, ranks []int) ([]Player, bool, error) {
+	r.Protect.Lock()
+	defer r.Protect.Unlock()
+	if r.reported {
+		return nil, false, ErrResultReported
+	}
+	for _, reported := range r.reports {
+		if !sameRanks(reported, ranks) {
+			return nil, false, ErrResultDisputed
+		}
+	}
+	r.reports[turn] = append([]int{}, ranks...)
+	for t, p := range r.seats {
+		if _, exists := r.reports[t]; p.Comm != nil && !exists {
+			return nil, false, nil
+		}
+	}
+	r.reported = true
+	return append([]Player{}, r.seated...), true, nil
+}
+
+func sameRanks(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// DisplayName returns the display name of the player seated at the turn, it
+// is empty if they never identified.
+func (r *Room) DisplayName(turn int) string {
+	r.Protect.RLock()
+	defer r.Protect.RUnlock()
+	if turn < 0 || turn >= len(r.seats) {
+		return ""
+	}
+	return r.seats[turn].Profile.DisplayName
+}
+
+// HasTeams returns true if the room's players are split into teams
+func (r *Room) HasTeams() bool {
+	return r.TeamCount > 0
+}
+
+// Team returns the team of the player with the given turn
+func (r *Room) Team(turn int) int {
+	if turn < 0 || turn >= len(r.teams) {
+		return 0
+	}
+	return r.teams[turn]
+}
+
+// Teammates returns the players on the given team that are still seated,
+// indexed by turn number.
+func (r *Room) Teammates(team int) map[int]Player {
+	r.Protect.RLock()
+	defer r.Protect.RUnlock()
+	mates := map[int]Player{}
+	for turn, p := range r.seats {
+		if r.teams[turn] == team && p.Comm != nil {
+			mates[turn] = p
+		}
+	}
+	return mates
+}
+
+// Spectators returns a copy of the room's spectators in the order they joined
+func (r *Room) Spectators() []Player {
+	r.Protect.RLock()
+	defer r.Protect.RUnlock()
+	return append([]Player{}, r.spectators...)
+}
+
+// AddSpectator adds the player to the room's read-only members as long as the
+// room allows it and is not at its maximum, zero meaning there is none.
+func (r *Room) AddSpectator(p Player) error {
+	r.Protect.Lock()
+	defer r.Protect.Unlock()
+	if r.NoSpectators {
+		return ErrNoSpectators
+	}
+	if r.MaxSpectators > 0 && len(r.spectators) >= r.MaxSpectators {
+		return ErrTooManySpectators
+	}
+	for _, x := range r.spectators {
+		if x.Comm.Id() == p.Comm.Id() {
+			return ErrAlreadySpectating
+		}
+	}
+	r.spectators = append(r.spectators, p)
+	return nil
+}
+
+// RemoveSpectator removes the spectator with the given id. It returns the
+// spectator and true if they were spectating the room.
+func (r *Room) RemoveSpectator(id string) (Player, bool) {
+	r.Protect.Lock()
+	defer r.Protect.Unlock()
+	for i, x := range r.spectators {
+		if x.Comm.Id() == id {
+			r.spectators = append(r.spectators[:i], r.spectators[i+1:]...)
+			return x, true
+		}
+	}
+	return Player{}, false
+}
+
+// CurrentTurn returns the turn number of the player that should move next
+func (r *Room) CurrentTurn() int {
+	r.Protect.RLock()
+	defer r.Protect.RUnlock()
+	return r.turn
+}
+
+// TakeTurn advances the room to the next occupied seat if the given turn is the
+// current one. It returns the next turn and true if the turn was taken or the
+// current turn and false if it was not the given turn's move.
+func (r *Room) TakeTurn(turn int) (int, bool) {
+	r.Protect.Lock()
+	defer r.Protect.Unlock()
+	if turn != r.turn {
+		return r.turn, false
+	}
+	r.advance()
+	return r.turn, true
+}
+
+// Vacate frees the seat of the given turn, if it was the current turn the room
+// advances to the next occupied seat. It returns true if the room is now empty.
+func (r *Room) Vacate(turn int) bool {
+	r.Protect.Lock()
+	defer r.Protect.Unlock()
+	if turn < 0 || turn >= len(r.seats) {
+		return r.empty()
+	}
+	r.seats[turn] = Player{}
+	if turn == r.turn {
+		r.advance()
+	}
+	return r.empty()
+}
+
+// State returns the room's shared state document encoded as JSON along with
+// its version. The version starts at 0 and goes up with every change.
+func (r *Room) State() (json.RawMessage, int) {
+	r.Protect.RLock()
+	defer r.Protect.RUnlock()
+	return r.encodeState(), r.version
+}
+
+// ReplaceState replaces the room's shared state document. It returns the new
+// document encoded as JSON along with its version.
+func (r *Room) ReplaceState(doc map[string]interface{}) (json.RawMessage, int) {
+	r.Protect.Lock()
+	defer r.Protect.Unlock()
+	r.state = doc
+	r.version++
+	return r.encodeState(), r.version
+}
+
+// PatchState applies a JSON merge patch to the room's shared state document.
+// It returns the new document encoded as JSON along with its version.
+func (r *Room) PatchState(patch map[string]interface{}) (json.RawMessage, int) {
+	r.Protect.Lock()
+	defer r.Protect.Unlock()
+	r.state = utils.MergePatch(r.state, patch).(map[string]interface{})
+	r.version++
+	return r.encodeState(), r.version
+}
+
+// encodeState must be called with the lock held. The state only ever holds
+// values decoded by encoding/json so encoding it can't fail.
+func (r *Room) encodeState() json.RawMessage {
+	raw, _ := json.Marshal(r.state)
+	return raw
+}
+
+// StartTurnTimer stops the running turn timer and, if the room has a turn
+// timeout, starts a new one for the current turn. When it expires onTimeout is
+// called with the turn it was started for unless the timer was stopped or
+// restarted in the meantime.
+func (r *Room) StartTurnTimer(onTimeout func(turn int)) {
+	r.Protect.Lock()
+	defer r.Protect.Unlock()
+	r.stopTimer()
+	if r.closed || r.TurnTimeout <= 0 {
+		return
+	}
+	seq, turn := r.timerSeq, r.turn
+	r.timer = time.AfterFunc(r.TurnTimeout, func() {
+		r.Protect.RLock()
+		stale := r.closed || seq != r.timerSeq
+		r.Protect.RUnlock()
+		if !stale {
+			onTimeout(turn)
+		}
+	})
+}
+
+// StopTurnTimer stops the running turn timer
+func (r *Room) StopTurnTimer() {
+	r.Protect.Lock()
+	defer r.Protect.Unlock()
+	r.stopTimer()
+}
+
+// Close stops the running turn timer and marks the room as closed so no new
+// timer is started. It returns false if the room was already closed.
+func (r *Room) Close() bool {
+	r.Protect.Lock()
+	defer r.Protect.Unlock()
+	if r.closed {
+		return false
+	}
+	r.closed = true
+	r.stopTimer()
+	return true
+}
+
+// stopTimer must be called with the lock held. Bumping the sequence makes a
+// timer that already fired but has not been handled yet a no-op.
+func (r *Room) stopTimer() {
+	r.timerSeq++
+	if r.timer != nil {
+		r.timer.Stop()
+		r.timer = nil
+	}
+}
+
+// advance moves the current turn to the next occupied seat. It must be called
+// with the lock held.
+func (r *Room) advance() {
+	for i := 1; i <= len(r.seats); i++ {
+		next := (r.turn + i) % len(r.seats)
+		if r.seats[next].Comm != nil {
+			r.turn = next
+			return
+		}
+	}
+}
+
+func (r *Room) empty() bool {
+	for _, p := range r.seats {
+		if p.Comm != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// RoomStore is a threadsafe store of the running rooms keyed by room name
+type RoomStore struct {
+	Protect *sync.RWMutex
+	data    map[string]*Room
+}
+
+// NewRoomStore instantiates a new room store
+func NewRoomStore() *RoomStore {
+	return &RoomStore{
+		Protect: &sync.RWMutex{},
+		data:    make(map[string]*Room),
+	}
+}
+
+// Set stores the room under its name
+func (rs *RoomStore) Set(r *Room) {
+	rs.Protect.Lock()
+	defer rs.Protect.Unlock()
+	rs.data[r.Name] = r
+}
+
+// Get returns the room with the given name
+func (rs *RoomStore) Get(name string) (*Room, bool) {
+	rs.Protect.RLock()
+	defer rs.Protect.RUnlock()
+	r, exists := rs.data[name]
+	return r, exists
+}
+
+// Del deletes the room with the given name
+func (rs *RoomStore) Del(name string) {
+	rs.Protect.Lock()
+	defer rs.Protect.Unlock()
+	delete(rs.data, name)
+}
+
+// All returns every running room ordered by name
+func (rs *RoomStore) All() []*Room {
+	rs.Protect.RLock()
+	defer rs.Protect.RUnlock()
+	rooms := make([]*Room, 0, len(rs.data))
+	for _, r := range rs.data {
+		rooms = append(rooms, r)
+	}
+	sort.Sort(byName(rooms))
+	return rooms
+}
+
+type byName []*Room
+
+func (b byName) Len() int           { return len(b) }
+func (b byName) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byName) Less(i, j int) bool { return b[i].Name < b[j].Name }
+
+// CountGame returns the number of running rooms of the game with the given
+// unique key.
+func (rs *RoomStore) CountGame(gameID string) int {
+	rs.Protect.RLock()
+	defer rs.Protect.RUnlock()
+	n := 0
+	for _, r := range rs.data {
+		if r.GameID == gameID {
+			n++
+		}
+	}
+	return n
+}
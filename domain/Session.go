@@ -0,0 +1,125 @@
+package domain
+
+import (
+	"sync"
+	"time"
+)
+
+// Session records the seat a player was given in a room so that a new socket
+// can reclaim it with the resume token after the original connection drops.
+type Session struct {
+	Token          string
+	PlayerID       string
+	RoomName       string
+	Turn           int
+	DisconnectedAt time.Time
+}
+
+// Connected returns true if the socket that owns the session is still alive.
+func (s Session) Connected() bool {
+	return s.DisconnectedAt.IsZero()
+}
+
+// SessionStore is a threadsafe store of sessions keyed by resume token, it
+// also keeps track of which token is currently bound to each player id.
+type SessionStore struct {
+	Protect  *sync.RWMutex
+	data     map[string]*Session
+	byPlayer map[string]string
+}
+
+// NewSessionStore instantiates a new session store
+func NewSessionStore() *SessionStore {
+	return &SessionStore{
+		Protect:  &sync.RWMutex{},
+		data:     make(map[string]*Session),
+		byPlayer: make(map[string]string),
+	}
+}
+
+// Add stores the session, replacing any session already bound to the player.
+func (ss *SessionStore) Add(s Session) {
+	ss.Protect.Lock()
+	defer ss.Protect.Unlock()
+	if old, exists := ss.byPlayer[s.PlayerID]; exists {
+		delete(ss.data, old)
+	}
+	ss.data[s.Token] = &s
+	ss.byPlayer[s.PlayerID] = s.Token
+}
+
+// Get returns the session stored under the given token
+func (ss *SessionStore) Get(token string) (Session, bool) {
+	ss.Protect.RLock()
+	defer ss.Protect.RUnlock()
+	s, exists := ss.data[token]
+	if !exists {
+		return Session{}, false
+	}
+	return *s, true
+}
+
+// ByPlayer returns the session currently bound to the player with the given id
+func (ss *SessionStore) ByPlayer(id string) (Session, bool) {
+	ss.Protect.RLock()
+	defer ss.Protect.RUnlock()
+	token, exists := ss.byPlayer[id]
+	if !exists {
+		return Session{}, false
+	}
+	return *ss.data[token], true
+}
+
+// Disconnect marks the session bound to the player as disconnected at the
+// given time. It returns the updated session and true if one was found.
+func (ss *SessionStore) Disconnect(id string, at time.Time) (Session, bool) {
+	ss.Protect.Lock()
+	defer ss.Protect.Unlock()
+	token, exists := ss.byPlayer[id]
+	if !exists {
+		return Session{}, false
+	}
+	s := ss.data[token]
+	s.DisconnectedAt = at
+	delete(ss.byPlayer, id)
+	return *s, true
+}
+
+// Rebind binds a disconnected session to a new player id as long as it was
+// disconnected less than grace ago. It returns the session and true on success.
+func (ss *SessionStore) Rebind(token, id string, grace time.Duration) (Session, bool) {
+	ss.Protect.Lock()
+	defer ss.Protect.Unlock()
+	s, exists := ss.data[token]
+	if !exists || s.Connected() || time.Since(s.DisconnectedAt) > grace {
+		return Session{}, false
+	}
+	s.PlayerID = id
+	s.DisconnectedAt = time.Time{}
+	ss.byPlayer[id] = token
+	return *s, true
+}
+
+// Expire removes the session if it is still disconnected since the given time,
+// this way a session that was reclaimed in the meantime is left alone.
+// It returns true if the session was removed.
+func (ss *SessionStore) Expire(token string, since time.Time) bool {
+	ss.Protect.Lock()
+	defer ss.Protect.Unlock()
+	s, exists := ss.data[token]
+	if !exists || !s.DisconnectedAt.Equal(since) {
+		return false
+	}
+	delete(ss.data, token)
+	return true
+}
+
+// Remove deletes the session bound to the player with the given id
+func (ss *SessionStore) Remove(id string) {
+	ss.Protect.Lock()
+	defer ss.Protect.Unlock()
+	if token, exists := ss.byPlayer[id]; exists {
+		delete(ss.data, token)
+		delete(ss.byPlayer, id)
+	}
+}
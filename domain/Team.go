@@ -0,0 +1,126 @@
+package domain
+
+import (
+	"math/rand"
+	"sort"
+)
+
+// Strategies used to split the players of a group into teams. Every strategy
+// keeps the players of a party on the same team unless no team can hold them.
+const (
+	// TeamsRoundRobin deals players out to the teams in the order they were
+	// grouped, it is the default.
+	TeamsRoundRobin = "round-robin"
+	// TeamsRandom places players on random teams of even size.
+	TeamsRandom = "random"
+	// TeamsPartyPreserving places the largest parties first so that parties
+	// are split as rarely as possible.
+	TeamsPartyPreserving = "party-preserving"
+)
+
+// Teams describes how the players of a group are split into teams. A Count of
+// zero means the game has no teams and a Size of zero means teams are only
+// kept even rather than capped.
+type Teams struct {
+	Count    int    `toml:"count"`
+	Size     int    `toml:"size"`
+	Strategy string `toml:"strategy"`
+}
+
+// Enabled returns true if the game splits its groups into teams
+func (t Teams) Enabled() bool {
+	return t.Count > 0
+}
+
+// Capacity returns how many players fit on each team of a group of n players,
+// which is the most a party can have without being split.
+func (t Teams) Capacity(n int) int {
+	if t.Size > 0 {
+		return t.Size
+	}
+	return (n + t.Count - 1) / t.Count
+}
+
+// Assign returns the team of each player, indexed like the players, following
+// the strategy. Teams are numbered from 0.
+func (t Teams) Assign(players []Player) []int {
+	teams := make([]int, len(players))
+	if !t.Enabled() {
+		return teams
+	}
+	parties := partiesOf(players)
+	switch t.Strategy {
+	case TeamsRandom:
+		shuffled := make([][]int, len(parties))
+		for i, j := range rand.Perm(len(parties)) {
+			shuffled[j] = parties[i]
+		}
+		parties = shuffled
+	case TeamsPartyPreserving:
+		sort.Stable(bySize(parties))
+	}
+	if !t.place(parties, len(players), teams) {
+		// Some party had to be split, placing the largest first splits the
+		// fewest of them.
+		sort.Stable(bySize(parties))
+		t.place(parties, len(players), teams)
+	}
+	return teams
+}
+
+// place puts each party on the team with the most room left, in order. It
+// returns false if a party had to be split because no team could hold it.
+func (t Teams) place(parties [][]int, n int, teams []int) bool {
+	free := make([]int, t.Count)
+	for i := range free {
+		free[i] = t.Capacity(n)
+	}
+	whole := true
+	for _, party := range parties {
+		for _, i := range party {
+			roomiest := 0
+			for team := range free {
+				if free[team] > free[roomiest] {
+					roomiest = team
+				}
+			}
+			// Keep filling the team the party started on while it has room.
+			if i != party[0] {
+				if free[teams[party[0]]] > 0 {
+					roomiest = teams[party[0]]
+				} else {
+					whole = false
+				}
+			}
+			teams[i] = roomiest
+			free[roomiest]--
+		}
+	}
+	return whole
+}
+
+// partiesOf returns the indexes of the players of each party in the order the
+// parties first appear. Players without a party are a party of their own.
+func partiesOf(players []Player) [][]int {
+	parties := [][]int{}
+	index := map[string]int{}
+	for i, p := range players {
+		if p.Party == "" {
+			parties = append(parties, []int{i})
+			continue
+		}
+		if at, exists := index[p.Party]; exists {
+			parties[at] = append(parties[at], i)
+			continue
+		}
+		index[p.Party] = len(parties)
+		parties = append(parties, []int{i})
+	}
+	return parties
+}
+
+type bySize [][]int
+
+func (b bySize) Len() int           { return len(b) }
+func (b bySize) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b bySize) Less(i, j int) bool { return len(b[i]) > len(b[j]) }
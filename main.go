@@ -1,20 +1,23 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
-	"errors"
-	"io"
+	"fmt"
+	"math/rand"
+	"net"
 	"net/http"
 	"os"
-	"path/filepath"
+	"os/signal"
+	"syscall"
 	"time"
+	"unicode/utf8"
 
 	"github.com/googollee/go-socket.io"
 
 	"github.com/tiltfactor/toto/domain"
 	"github.com/tiltfactor/toto/utils"
 
-	"github.com/BurntSushi/toml"
 	"github.com/jesusrmoreno/sad-squid"
 
 	logrus "github.com/Sirupsen/logrus"
@@ -24,6 +27,7 @@ import (
 var log *logrus.Logger
 
 func init() {
+	rand.Seed(time.Now().UnixNano())
 	log = logrus.New()
 	log.Formatter = &logrus.TextFormatter{
 		FullTimestamp: true,
@@ -36,15 +40,52 @@ var Version = "1.3.3"
 
 // Events that are exposed to the client
 const (
-	connection       = "connection"
-	disconnection    = "disconnection"
-	playerDisconnect = "player-disconnect"
-	groupAssignment  = "group-assignment"
-	roomMessage      = "room-message"
-	joinGame         = "join-game"
-	makeMove         = "make-move"
-	moveMade         = "move-made"
-	inQueue          = "in-queue"
+	connection        = "connection"
+	disconnection     = "disconnection"
+	playerDisconnect  = "player-disconnect"
+	groupAssignment   = "group-assignment"
+	roomMessage       = "room-message"
+	joinGame          = "join-game"
+	makeMove          = "make-move"
+	moveMade          = "move-made"
+	inQueue           = "in-queue"
+	rejoinRoom        = "rejoin-room"
+	playerReconnected = "player-reconnected"
+	createPrivateRoom = "create-private-room"
+	joinPrivateRoom   = "join-private-room"
+	startPrivateRoom  = "start-private-room"
+	privateRoomUpdate = "private-room-update"
+	turnChanged       = "turn-changed"
+	turnTimeout       = "turn-timeout"
+	roomClosed        = "room-closed"
+	directMessage     = "direct-message"
+	teamMessage       = "team-message"
+	leaveQueue        = "leave-queue"
+	leaveRoom         = "leave-room"
+	leftQueue         = "left-queue"
+	leftRoom          = "left-room"
+	playerLeft        = "player-left"
+	setState          = "set-state"
+	patchState        = "patch-state"
+	stateChanged      = "state-changed"
+	kicked            = "kicked"
+	matchFound        = "match-found"
+	ready             = "ready"
+	decline           = "decline"
+	matchCancelled    = "match-cancelled"
+	spectateRoom      = "spectate-room"
+	spectating        = "spectating"
+	reportResult      = "report-result"
+	identify          = "identify"
+	identified        = "identified"
+	ratingsUpdated    = "ratings-updated"
+	createParty       = "create-party"
+	inviteToParty     = "invite-to-party"
+	joinParty         = "join-party"
+	leaveParty        = "leave-party"
+	partyInvite       = "party-invite"
+	partyUpdate       = "party-update"
+	serverShutdown    = "server-shutdown"
 
 	serverError = "server-error"
 	clientError = "client-error"
@@ -58,8 +99,56 @@ type Response struct {
 }
 
 // GameJoinRequest is the request that the client should sent to get a room.
+// Rating seeds the rating of players who have none yet in games with rating
+// matchmaking.
 type GameJoinRequest struct {
-	GameID string `json:"gameId"`
+	GameID string   `json:"gameId"`
+	Rating *float64 `json:"rating"`
+}
+
+// RejoinRequest is the request that the client should send to reclaim its
+// seat in a room after its previous socket was disconnected.
+type RejoinRequest struct {
+	ResumeToken string `json:"resumeToken"`
+}
+
+// PrivateRoomRequest is the request that the client should send to join a
+// private room using the code that was shared by its host.
+type PrivateRoomRequest struct {
+	Code string `json:"code"`
+}
+
+// SpectateRequest is the request that the client should send to watch a
+// running room.
+type SpectateRequest struct {
+	RoomName string `json:"roomName"`
+}
+
+// PartyInviteRequest is the request that the leader of a party should send to
+// invite another player to it.
+type PartyInviteRequest struct {
+	PlayerID string `json:"playerId"`
+}
+
+// PartyJoinRequest is the request that the client should send to accept an
+// invite to a party.
+type PartyJoinRequest struct {
+	PartyID string `json:"partyId"`
+}
+
+// ResultRequest is the request that a player should send to report the result
+// of a rated room. Ranks are indexed by turn number, lower is better and equal
+// ranks are a draw.
+type ResultRequest struct {
+	Ranks []int `json:"ranks"`
+}
+
+// MessageRequest is the request that the client should send to chat with the
+// other members of its room. To is the turn number of the recipient of a
+// direct-message and is ignored for room-message.
+type MessageRequest struct {
+	Text string `json:"text"`
+	To   *int   `json:"to"`
 }
 
 // Control serves to store the metadata for different games
@@ -68,6 +157,46 @@ type Control struct {
 	TurnMap *utils.ConcurrentStringIntMap
 	// Maps the player id to the room
 	RoomMap *utils.ConcurrentStringMap
+	// Maps the player id to the game whose lobby they are queued in
+	QueueMap *utils.ConcurrentStringMap
+	// Maps the spectator id to the room they are watching
+	SpectatorMap *utils.ConcurrentStringMap
+	// Groups waiting for their players to be ready, keyed by match id
+	Matches *domain.MatchStore
+	// Maps the resume tokens handed out in group-assignment to player seats
+	Sessions *domain.SessionStore
+	// How long a disconnected player's seat is held for rejoin-room
+	ReconnectGrace time.Duration
+	// Private rooms that are still waiting for players, keyed by their code
+	PrivateRooms *domain.PrivateRoomStore
+	// Parties of players that queue together, keyed by their id
+	Parties *domain.PartyStore
+	// Verifies the token of each connection, nil when auth is off
+	Auth *Authenticator
+	// Maps the socket id to the id of the user its token was issued to
+	Users *utils.ConcurrentStringMap
+	// Player profiles keyed by their id
+	Players domain.PlayerStore
+	// Maps the socket id to the id of the profile it identified with
+	Identities *utils.ConcurrentStringMap
+	// The rating of each player in games with rating matchmaking
+	Ratings domain.RatingStore
+	// Maps the room name to the state of the running room
+	Rooms *domain.RoomStore
+	// Used to reach the members of a room from outside of a socket handler
+	Broadcaster Broadcaster
+	// The maximum number of characters in a chat message
+	MaxMessageLength int
+	// Records the responses sent to each room, nil when recording is off
+	Recorder *Recorder
+	// Tells whether the server is shutting down
+	Drainer *Drainer
+}
+
+// Broadcaster sends an event to every socket in a room, it is satisfied by the
+// socketio.Server.
+type Broadcaster interface {
+	BroadcastTo(room, event string, args ...interface{})
 }
 
 // QueuePlayers adds players to the game's lobby to wait for a partner.
@@ -83,57 +212,246 @@ func QueuePlayers(g domain.Game, p domain.Player) bool {
 
 // GroupPlayers attempts to creates groups of players of the size defined in the
 // game files. It also sets the player turns.
-// It returns the name of the room and true if it succeeded or
-// an empty string and false if it did not.
+// Groups of maxPlayers are formed as soon as there are enough players, once the
+// oldest player has waited for the game's fillTimeout any group of at least
+// minPlayers is formed instead.
+// It returns the name of the room and the players in it if it succeeded or
+// an empty string and nil if it did not.
 func GroupPlayers(g domain.Game, gi *Control) (string, []domain.Player) {
 	log.Debug("Attempting to group players for game", g.UUID)
-	pq := g.Lobby
+	team := popGroup(g)
+	if team == nil {
+		return "", nil
+	}
+	roomName := squid.GenerateSimpleID()
+	SeatPlayers(roomName, g, team, gi)
+	observeQueueWait(g, team)
+	return roomName, team
+}
+
+// popGroup pops a group of players from the game's lobby as sized by the game
+// files, it returns nil if no group could be formed.
+func popGroup(g domain.Game) []domain.Player {
 	max := g.MaxPlayers
 	min := g.MinPlayers
 	if max == 0 {
 		max = min
 	}
-	available := pq.Size()
-	for needed := max; needed >= min; needed-- {
-		if available >= max {
-			team := []domain.Player{}
-			roomName := squid.GenerateSimpleID()
-			for i := 0; i < needed; i++ {
-				p := pq.PopFromQueue()
-				team = append(team, p)
-
-				// Place the player in the created room.
-				p.Comm.Join(roomName)
-
-				playerID := p.Comm.Id()
-				gi.RoomMap.Set(playerID, roomName)
-
-				// We generate a turn key composed of the room name and player id to store
-				// the turn. turns are assigned based off of how they are popped from the
-				// queue.
-				tk := TurnKey(playerID, roomName)
-				gi.TurnMap.Set(tk, i)
+	if g.Rated() {
+		return g.Lobby.PopRatedGroup(min, max, g.FillWait(), g.Spread)
+	}
+	return g.Lobby.PopGroup(min, max, g.FillWait())
+}
+
+// observeQueueWait records how long each player of the group waited in the
+// game's lobby before being seated.
+func observeQueueWait(g domain.Game, group []domain.Player) {
+	for _, p := range group {
+		metrics.QueueWait.Observe(time.Since(p.QueuedAt).Seconds(), g.UUID)
+	}
+}
+
+// MatchPlayers attempts to form a group for the game. The group is seated and
+// announced right away unless the game has a ready check, in which case its
+// players are first asked to accept the match.
+func MatchPlayers(g domain.Game, games *domain.GameStore, info Control) {
+	// No new rooms are started while the server shuts down.
+	if info.Drainer.Draining() {
+		return
+	}
+	if g.ReadyCheckSeconds == 0 {
+		if rn, group := GroupPlayers(g, &info); group != nil {
+			AnnounceGroup(rn, group, info)
+		}
+		return
+	}
+	log.Debug("Attempting to match players for game", g.UUID)
+	if group := popGroup(g); group != nil {
+		ProposeMatch(g, group, games, info)
+	}
+}
+
+// FillGroups periodically attempts to group the players of every game that
+// defines a fillTimeout, so that groups smaller than maxPlayers are formed once
+// the timeout elapses even if nobody else joins the queue. Games with rating
+// matchmaking are retried as well since the spread they allow keeps growing.
+func FillGroups(games *domain.GameStore, info Control, interval time.Duration) {
+	for range time.Tick(interval) {
+		for _, g := range games.All() {
+			if (g.FillTimeout == 0 && !g.Rated()) || g.Lobby.Size() < g.MinPlayers {
+				continue
 			}
-			return roomName, team
+			MatchPlayers(g, games, info)
 		}
 	}
-	return "", nil
 }
 
-// Cross origin server is used to add cross-origin request capabilities to the
-// socket server. It wraps the socketio.Server
-type crossOriginServer struct {
-	Server *socketio.Server
+// SeatPlayers places each player in the room and stores their room and turn in
+// the control maps. Turns are assigned in the order the players are given.
+func SeatPlayers(roomName string, g domain.Game, players []domain.Player,
+	gi *Control) {
+	gi.Rooms.Set(domain.NewRoom(roomName, g, players))
+	gi.Recorder.Open(roomName)
+	metrics.RoomsCreated.Inc(g.UUID)
+	for i, p := range players {
+		// Place the player in the created room.
+		p.Comm.Join(roomName)
+
+		playerID := p.Comm.Id()
+		gi.QueueMap.Del(playerID)
+		gi.RoomMap.Set(playerID, roomName)
+
+		// We generate a turn key composed of the room name and player id to store
+		// the turn.
+		tk := TurnKey(playerID, roomName)
+		gi.TurnMap.Set(tk, i)
+	}
+}
+
+// AnnounceGroup tells each member of a newly seated group what their room name
+// is as well as their turn, and hands out the resume token for their seat.
+func AnnounceGroup(rn string, group []domain.Player, info Control) {
+	for i, p := range group {
+		token := utils.RandomToken(16)
+		info.Sessions.Add(domain.Session{
+			Token:    token,
+			PlayerID: p.Comm.Id(),
+			RoomName: rn,
+			Turn:     i,
+		})
+		data := map[string]interface{}{}
+		data["roomName"] = rn
+		data["turnNumber"] = i
+		addCurrentTurn(data, rn, info)
+		addTeam(data, rn, i, info)
+		r := WrapResponse(groupAssignment, data)
+		// The resume token is left out of the recording.
+		turn := i
+		info.Recorder.Record(rn, groupAssignment, &turn, r)
+		data["resumeToken"] = token
+		p.Comm.Emit(groupAssignment, r)
+	}
+	StartTurnTimer(rn, info)
 }
 
-// ServeHTTP is implemented to add the needed header for CORS in socketio.
-// This must be named ServeHTTP and take the
-// (http.ResponseWriter, r *http.Request) to satisfy the http.Handler interface
-func (s crossOriginServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Access-Control-Allow-Credentials", "true")
-	origin := r.Header.Get("Origin")
-	w.Header().Set("Access-Control-Allow-Origin", origin)
-	s.Server.ServeHTTP(w, r)
+// addCurrentTurn adds the turn number of the player that should move next to
+// the data if the server enforces the turn order of the room.
+func addCurrentTurn(data map[string]interface{}, rn string, info Control) {
+	if room, exists := info.Rooms.Get(rn); exists && room.StrictTurns() {
+		data["currentTurn"] = room.CurrentTurn()
+	}
+}
+
+// addTeam adds the team of the player with the given turn to the data if the
+// room's players are split into teams.
+func addTeam(data map[string]interface{}, rn string, turn int, info Control) {
+	if room, exists := info.Rooms.Get(rn); exists && room.HasTeams() {
+		data["team"] = room.Team(turn)
+	}
+}
+
+// ReleaseSeat frees the seat of the given turn once its player is gone for
+// good. If the room was waiting on that player the rest of the room is told
+// whose turn it is now, and the room is closed once every seat is free.
+func ReleaseSeat(rn string, turn int, info Control) {
+	room, exists := info.Rooms.Get(rn)
+	if !exists {
+		return
+	}
+	before := room.CurrentTurn()
+	if room.Vacate(turn) {
+		// Only spectators are left to be told.
+		CloseRoom(rn, "Every player has left", info)
+		return
+	}
+	if next := room.CurrentTurn(); room.StrictTurns() && next != before {
+		EmitTurnChanged(rn, next, info)
+	}
+}
+
+// EmitTurnChanged tells every member of the room whose turn it is and starts
+// the clock for that turn.
+func EmitTurnChanged(rn string, turn int, info Control) {
+	m := map[string]interface{}{}
+	m["turnNumber"] = turn
+	info.Broadcaster.BroadcastTo(rn, turnChanged, WrapResponse(turnChanged, m))
+	StartTurnTimer(rn, info)
+}
+
+// StartTurnTimer starts the clock for the current turn of the room if the
+// server enforces its turn order and its game defines a turn timeout.
+func StartTurnTimer(rn string, info Control) {
+	room, exists := info.Rooms.Get(rn)
+	if !exists || !room.StrictTurns() {
+		return
+	}
+	room.StartTurnTimer(func(turn int) {
+		HandleTurnTimeout(rn, turn, info)
+	})
+}
+
+// HandleTurnTimeout is called when a player runs out of time for their turn.
+// The room is told about it and then either the turn passes on to the next
+// player or the room is closed, depending on the game's timeout policy.
+func HandleTurnTimeout(rn string, turn int, info Control) {
+	room, exists := info.Rooms.Get(rn)
+	if !exists {
+		return
+	}
+	policy := room.TimeoutPolicy
+	if policy == "" {
+		policy = domain.TimeoutPolicySkip
+	}
+	log.Debug("Turn", turn, "timed out in", rn)
+	m := map[string]interface{}{}
+	m["turnNumber"] = turn
+	m["policy"] = policy
+	info.Broadcaster.BroadcastTo(rn, turnTimeout, WrapResponse(turnTimeout, m))
+	if policy == domain.TimeoutPolicyEnd {
+		CloseRoom(rn, turnTimeout, info)
+		return
+	}
+	if next, ok := room.TakeTurn(turn); ok {
+		EmitTurnChanged(rn, next, info)
+	}
+}
+
+// CloseRoom ends the room: its timers are stopped, its members are told why
+// it closed and every player and spectator is removed from it and from the
+// control maps.
+func CloseRoom(rn, reason string, info Control) {
+	room, exists := info.Rooms.Get(rn)
+	if !exists || !room.Close() {
+		return
+	}
+	log.Debug("Closing room", rn, "because of", reason)
+	info.Rooms.Del(rn)
+	m := map[string]interface{}{}
+	m["reason"] = reason
+	info.Broadcaster.BroadcastTo(rn, roomClosed, WrapResponse(roomClosed, m))
+	info.Recorder.Close(rn)
+	for _, p := range room.Seats() {
+		if p.Comm == nil {
+			continue
+		}
+		playerID := p.Comm.Id()
+		p.Comm.Leave(rn)
+		info.RoomMap.Del(playerID)
+		info.TurnMap.Del(TurnKey(playerID, rn))
+		info.Sessions.Remove(playerID)
+	}
+	for _, p := range room.Spectators() {
+		p.Comm.Leave(rn)
+		info.SpectatorMap.Del(p.Comm.Id())
+	}
+}
+
+// PrivateRoomCode generates a short human readable code for a private room
+// such as "cheerful-otters-42".
+func PrivateRoomCode() string {
+	adj := squid.SimpleAdjectives[rand.Intn(len(squid.SimpleAdjectives))]
+	noun := squid.SimpleSubjects[rand.Intn(len(squid.SimpleSubjects))]
+	return fmt.Sprintf("%s-%s-%d", adj, noun, rand.Intn(90)+10)
 }
 
 // HandlePlayerJoin is called when a player makes a request to join a game
@@ -144,21 +462,37 @@ func (s crossOriginServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 // Also because the Queue is protected by a mutex we don't need to worry about
 // players getting assigned to multiple rooms.
 func HandlePlayerJoin(so socketio.Socket, r GameJoinRequest,
-	games domain.GameMap, info Control) {
+	games *domain.GameStore, info Control) {
+	if rejectWhileDraining(so, info) {
+		return
+	}
 	gameID := r.GameID
 	if gameID == "" {
 		log.Debug("No game included from", so.Id())
 		so.Emit(clientError, ErrorResponse(clientError, "Must include GameID"))
 	}
 	log.Debug(so.Id(), "attempting to join game", gameID)
+	// A player is in one queue, room or private room at a time.
+	if !canEnterRoom(so, info) {
+		return
+	}
 	// If the player attempts to connect to a game we first have to make
 	// sure that they are joining a game that is registered with our server.
-	if g, exists := games[gameID]; exists {
+	if g, exists := games.Playable(gameID); exists {
+		// A party is queued as a whole by its leader.
+		if party, inParty := info.Parties.ByPlayer(so.Id()); inParty {
+			QueueParty(so, r, party, g, games, info)
+			return
+		}
 		// First queue the player
-		newPlayer := domain.Player{
-			Comm: so,
+		newPlayer := RatePlayer(g, NewPlayer(so, info), r.Rating, info)
+		// A player waits in one lobby at a time. The game is recorded before
+		// queueing so that a group formed right away clears it.
+		_, queued := info.QueueMap.Get(so.Id())
+		if !queued {
+			info.QueueMap.Set(so.Id(), g.UUID)
 		}
-		if didQueue := QueuePlayers(g, newPlayer); didQueue {
+		if didQueue := !queued && QueuePlayers(g, newPlayer); didQueue {
 			// Create the response we're going to send
 			r := WrapResponse(inQueue, struct {
 				Msg            string `json:"message"`
@@ -168,16 +502,7 @@ func HandlePlayerJoin(so socketio.Socket, r GameJoinRequest,
 				PlayersInQueue: g.Lobby.Size(),
 			})
 			so.Emit(inQueue, r)
-			if rn, group := GroupPlayers(g, &info); group != nil && rn != "" {
-				// Tell each member what their room name is as well as their turn
-				for i, p := range group {
-					data := map[string]interface{}{}
-					data["roomName"] = rn
-					data["turnNumber"] = i
-					r := WrapResponse(groupAssignment, data)
-					p.Comm.Emit(groupAssignment, r)
-				}
-			}
+			MatchPlayers(g, games, info)
 		} else {
 			// Create the response we're going to send
 			data := map[string]interface{}{}
@@ -191,93 +516,838 @@ func HandlePlayerJoin(so socketio.Socket, r GameJoinRequest,
 	}
 }
 
-// StartServer loads the games from the games directory (exits on error)
-// Creates the socket io server and wraps it to accept all origins
+// HandleLeaveQueue is called when a player no longer wants to wait for a group
+// in the game they are queued for.
+func HandleLeaveQueue(so socketio.Socket, games *domain.GameStore, info Control) {
+	gameID, ok := DequeuePlayer(so.Id(), games, info)
+	if !ok {
+		so.Emit(clientError, ErrorResponse(clientError, "Not in any queue"))
+		return
+	}
+	log.Debug(so.Id(), "left the queue for", gameID)
+	data := map[string]interface{}{}
+	data["gameId"] = gameID
+	so.Emit(leftQueue, WrapResponse(leftQueue, data))
+}
+
+// HandleLeaveRoom is called when a player leaves their room, the private room
+// they are waiting in or the room they are spectating, without disconnecting.
+// Their seat is given up for good and the remaining members are told who left,
+// so that the socket can go on to join another game.
+func HandleLeaveRoom(so socketio.Socket, info Control) {
+	if rn, ok := StopSpectating(so.Id(), info); ok {
+		data := map[string]interface{}{}
+		data["roomName"] = rn
+		so.Emit(leftRoom, WrapResponse(leftRoom, data))
+		return
+	}
+	if pr, ok := info.PrivateRooms.Remove(so.Id()); ok {
+		EmitPrivateRoomUpdate(pr)
+		data := map[string]interface{}{}
+		data["code"] = pr.Code
+		so.Emit(leftRoom, WrapResponse(leftRoom, data))
+		return
+	}
+	room, turn, ok := RemoveFromRoom(so.Id(), info)
+	if !ok {
+		so.Emit(clientError, ErrorResponse(clientError, "Not in any Room"))
+		return
+	}
+	log.Debug(so.Id(), "left", room)
+	so.Leave(room)
+	info.Sessions.Remove(so.Id())
+	m := map[string]interface{}{}
+	m["player"] = turn
+	info.Broadcaster.BroadcastTo(room, playerLeft, WrapResponse(playerLeft, m))
+	ReleaseSeat(room, turn, info)
+
+	data := map[string]interface{}{}
+	data["roomName"] = room
+	so.Emit(leftRoom, WrapResponse(leftRoom, data))
+}
+
+// DequeuePlayer removes the player from the lobby of the game they are queued
+// for, or from the match they were found for. It returns the game id and true
+// if they were queued.
+func DequeuePlayer(id string, games *domain.GameStore, info Control) (string, bool) {
+	gameID, exists := info.QueueMap.Get(id)
+	if !exists {
+		return "", false
+	}
+	info.QueueMap.Del(id)
+	if g, exists := games.Get(gameID); exists {
+		g.Lobby.Remove(id)
+	}
+	// Leaving during a ready check counts as declining the match.
+	if m, exists := info.Matches.ByPlayer(id); exists {
+		CancelMatch(m.ID, []string{id}, "A player left", games, info)
+	}
+	return gameID, true
+}
+
+// RemoveFromRoom removes the player from the room and turn maps. It returns
+// the room and turn the player had and true if they were in a room.
+func RemoveFromRoom(id string, info Control) (string, int, bool) {
+	room, exists := info.RoomMap.Get(id)
+	if !exists {
+		return "", 0, false
+	}
+	tk := TurnKey(id, room)
+	turn, exists := info.TurnMap.Get(tk)
+	info.RoomMap.Del(id)
+	info.TurnMap.Del(tk)
+	return room, turn, exists
+}
+
+// HandlePlayerRejoin is called when a player attempts to reclaim a seat with
+// the resume token it was given in group-assignment. If the seat's previous
+// socket disconnected less than the grace window ago the new socket takes over
+// the room and turn number and the rest of the room is told the player is back.
+func HandlePlayerRejoin(so socketio.Socket, r RejoinRequest, info Control) {
+	if r.ResumeToken == "" {
+		log.Debug("No resume token included from", so.Id())
+		so.Emit(clientError, ErrorResponse(clientError, "Must include resumeToken"))
+		return
+	}
+	if !canEnterRoom(so, info) {
+		return
+	}
+	s, ok := info.Sessions.Get(r.ResumeToken)
+	room, exists := info.Rooms.Get(s.RoomName)
+	if ok && !exists {
+		so.Emit(clientError, ErrorResponse(clientError, "Room has closed"))
+		return
+	}
+	s, ok = info.Sessions.Rebind(r.ResumeToken, so.Id(), info.ReconnectGrace)
+	if !ok {
+		log.Debug("Invalid or expired resume token from", so.Id())
+		so.Emit(clientError, ErrorResponse(clientError, "Invalid or expired resumeToken"))
+		return
+	}
+	room.Rebind(s.Turn, NewPlayer(so, info))
+	so.Join(s.RoomName)
+	info.RoomMap.Set(so.Id(), s.RoomName)
+	info.TurnMap.Set(TurnKey(so.Id(), s.RoomName), s.Turn)
+	log.Debug(so.Id(), "rejoined", s.RoomName, "as turn", s.Turn)
+
+	data := map[string]interface{}{}
+	data["roomName"] = s.RoomName
+	data["turnNumber"] = s.Turn
+	data["resumeToken"] = s.Token
+	addCurrentTurn(data, s.RoomName, info)
+	addTeam(data, s.RoomName, s.Turn, info)
+	so.Emit(groupAssignment, WrapResponse(groupAssignment, data))
+
+	m := map[string]interface{}{}
+	m["player"] = s.Turn
+	rr := WrapResponse(playerReconnected, m)
+	info.Recorder.Record(s.RoomName, playerReconnected, nil, rr)
+	so.BroadcastTo(s.RoomName, playerReconnected, rr)
+	if state, version := room.State(); version > 0 {
+		so.Emit(stateChanged, StateResponse(state, version, nil))
+	}
+	// The clock stopped when the player disconnected on their turn.
+	if room.CurrentTurn() == s.Turn {
+		StartTurnTimer(s.RoomName, info)
+	}
+}
+
+// HandleCreatePrivateRoom is called when a player asks for a private room for
+// a game. The player becomes the host of the room and is sent the code that
+// the other players need in order to join it.
+func HandleCreatePrivateRoom(so socketio.Socket, r GameJoinRequest,
+	games *domain.GameStore, info Control) {
+	if rejectWhileDraining(so, info) {
+		return
+	}
+	g, exists := games.Playable(r.GameID)
+	if !exists {
+		log.Debug("Invalid GameId from", so.Id())
+		so.Emit(clientError, ErrorResponse(clientError, "Invalid GameID"))
+		return
+	}
+	if !canEnterRoom(so, info) {
+		return
+	}
+	max := g.MaxPlayers
+	if max == 0 {
+		max = g.MinPlayers
+	}
+	host := NewPlayer(so, info)
+	pr := domain.PrivateRoom{
+		GameID:     g.UUID,
+		MinPlayers: g.MinPlayers,
+		MaxPlayers: max,
+	}
+	// Codes are short so we keep generating them until we find a free one.
+	pr.Code = PrivateRoomCode()
+	for !info.PrivateRooms.Create(pr, host) {
+		pr.Code = PrivateRoomCode()
+	}
+	log.Debug(so.Id(), "created private room", pr.Code, "for game", g.UUID)
+	pr, _ = info.PrivateRooms.ByPlayer(so.Id())
+	EmitPrivateRoomUpdate(pr)
+}
+
+// HandleJoinPrivateRoom is called when a player uses a code to join a private
+// room. Once the room is full it is started automatically.
+func HandleJoinPrivateRoom(so socketio.Socket, r PrivateRoomRequest,
+	games *domain.GameStore, info Control) {
+	if rejectWhileDraining(so, info) {
+		return
+	}
+	if r.Code == "" {
+		log.Debug("No code included from", so.Id())
+		so.Emit(clientError, ErrorResponse(clientError, "Must include code"))
+		return
+	}
+	if !canEnterRoom(so, info) {
+		return
+	}
+	pr, err := info.PrivateRooms.Join(r.Code, NewPlayer(so, info))
+	if err != nil {
+		log.Debug(so.Id(), "could not join private room", r.Code, err)
+		so.Emit(clientError, ErrorResponse(clientError, err.Error()))
+		return
+	}
+	log.Debug(so.Id(), "joined private room", pr.Code)
+	if len(pr.Players) >= pr.MaxPlayers {
+		StartPrivateRoom(pr.Code, games, info)
+		return
+	}
+	EmitPrivateRoomUpdate(pr)
+}
+
+// HandleStartPrivateRoom is called when the host of a private room wants to
+// start it before it is full. The room must hold at least minPlayers.
+func HandleStartPrivateRoom(so socketio.Socket, games *domain.GameStore,
+	info Control) {
+	if rejectWhileDraining(so, info) {
+		return
+	}
+	pr, exists := info.PrivateRooms.ByPlayer(so.Id())
+	if !exists {
+		so.Emit(clientError, ErrorResponse(clientError, "Not in a private room"))
+		return
+	}
+	if pr.Host != so.Id() {
+		so.Emit(clientError, ErrorResponse(clientError, "Only the host can start the room"))
+		return
+	}
+	if len(pr.Players) < pr.MinPlayers {
+		so.Emit(clientError, ErrorResponse(clientError, "Not enough players to start"))
+		return
+	}
+	StartPrivateRoom(pr.Code, games, info)
+}
+
+// StartPrivateRoom turns the private room with the given code into a regular
+// room and sends group-assignment to its players in the order they joined. If
+// the game was removed the room is discarded and its players are told so.
+func StartPrivateRoom(code string, games *domain.GameStore, info Control) {
+	pr, exists := info.PrivateRooms.Take(code)
+	if !exists {
+		return
+	}
+	// A reload may have removed the game while the players were waiting.
+	g, exists := games.Get(pr.GameID)
+	if !exists {
+		for _, p := range pr.Players {
+			p.Comm.Emit(clientError, ErrorResponse(clientError, "Game is no longer available"))
+		}
+		return
+	}
+	rn := squid.GenerateSimpleID()
+	log.Debug("Starting private room", code, "as", rn)
+	// Private rooms skip matchmaking but their results still count.
+	players := make([]domain.Player, len(pr.Players))
+	for i, p := range pr.Players {
+		players[i] = RatePlayer(g, p, nil, info)
+	}
+	SeatPlayers(rn, g, players, &info)
+	AnnounceGroup(rn, players, info)
+}
+
+// EmitPrivateRoomUpdate tells every player waiting in the private room who is
+// in it and whether they are the host.
+func EmitPrivateRoomUpdate(pr domain.PrivateRoom) {
+	for _, p := range pr.Players {
+		data := map[string]interface{}{}
+		data["code"] = pr.Code
+		data["gameId"] = pr.GameID
+		data["isHost"] = p.Comm.Id() == pr.Host
+		data["playersInRoom"] = len(pr.Players)
+		data["minPlayers"] = pr.MinPlayers
+		data["maxPlayers"] = pr.MaxPlayers
+		p.Comm.Emit(privateRoomUpdate, WrapResponse(privateRoomUpdate, data))
+	}
+}
+
+// canEnterRoom emits a client error and returns false if the player is
+// already in a room, in a queue, waiting in a private room or spectating.
+func canEnterRoom(so domain.Comm, info Control) bool {
+	if _, queued := info.QueueMap.Get(so.Id()); queued {
+		so.Emit(clientError, ErrorResponse(clientError, "Already in queue"))
+		return false
+	}
+	if _, inRoom := info.RoomMap.Get(so.Id()); inRoom {
+		so.Emit(clientError, ErrorResponse(clientError, "Already in a room"))
+		return false
+	}
+	if _, waiting := info.PrivateRooms.ByPlayer(so.Id()); waiting {
+		so.Emit(clientError, ErrorResponse(clientError, "Already in a private room"))
+		return false
+	}
+	if _, watching := info.SpectatorMap.Get(so.Id()); watching {
+		so.Emit(clientError, ErrorResponse(clientError, "Already spectating a room"))
+		return false
+	}
+	return true
+}
+
+// HandleSpectateRoom is called when a socket asks to watch a running room. It
+// joins the room as a read-only member: it receives what is broadcast to the
+// room but has no turn, so it can't make moves or change the state. Games can
+// disable spectating or cap the number of spectators of each room.
+func HandleSpectateRoom(so socketio.Socket, r SpectateRequest, info Control) {
+	if r.RoomName == "" {
+		so.Emit(clientError, ErrorResponse(clientError, "Must include roomName"))
+		return
+	}
+	if !canEnterRoom(so, info) {
+		return
+	}
+	room, exists := info.Rooms.Get(r.RoomName)
+	if !exists {
+		so.Emit(clientError, ErrorResponse(clientError, "No room with that name"))
+		return
+	}
+	if err := room.AddSpectator(NewPlayer(so, info)); err != nil {
+		so.Emit(clientError, ErrorResponse(clientError, err.Error()))
+		return
+	}
+	info.SpectatorMap.Set(so.Id(), r.RoomName)
+	so.Join(r.RoomName)
+	log.Debug(so.Id(), "is spectating", r.RoomName)
+
+	data := map[string]interface{}{}
+	data["roomName"] = r.RoomName
+	data["gameId"] = room.GameID
+	data["players"] = len(room.Seats())
+	data["spectators"] = len(room.Spectators())
+	addCurrentTurn(data, r.RoomName, info)
+	so.Emit(spectating, WrapResponse(spectating, data))
+	if state, version := room.State(); version > 0 {
+		so.Emit(stateChanged, StateResponse(state, version, nil))
+	}
+}
+
+// StopSpectating removes the spectator from the room they are watching. It
+// returns the room and true if they were spectating one.
+func StopSpectating(id string, info Control) (string, bool) {
+	rn, exists := info.SpectatorMap.Get(id)
+	if !exists {
+		return "", false
+	}
+	info.SpectatorMap.Del(id)
+	if room, exists := info.Rooms.Get(rn); exists {
+		if p, ok := room.RemoveSpectator(id); ok {
+			p.Comm.Leave(rn)
+		}
+	}
+	return rn, true
+}
+
+// HandleMakeMove is called when a player makes a move. The move is relayed to
+// every member of the player's room with the player's turn and id attached.
+// If the game has a move schema, moves that don't match it are rejected with
+// the list of problems found. If the server enforces the turn order of the
+// room, moves made out of turn are rejected and the room is told whose turn it
+// is after each accepted move.
+func HandleMakeMove(so socketio.Socket, move json.RawMessage, info Control) {
+	if _, watching := info.SpectatorMap.Get(so.Id()); watching {
+		so.Emit(clientError, ErrorResponse(clientError, "Spectators cannot make moves"))
+		return
+	}
+	room, exists := info.RoomMap.Get(so.Id())
+	log.Println(string(move))
+	if !exists {
+		log.Debug("No room assigned for", so.Id())
+		so.Emit(serverError, ErrorResponse(serverError, "Not in any Room"))
+		return
+	}
+	m := map[string]interface{}{}
+	if err := json.Unmarshal(move, &m); err != nil {
+		log.Debug("Invalid JSON from", so.Id(), string(move))
+		so.Emit(clientError, ErrorResponse(clientError, "Invalid JSON"))
+		return
+	}
+	turn, exists := info.TurnMap.Get(TurnKey(so.Id(), room))
+	if !exists {
+		log.Debug("No turn assigned", so.Id())
+		so.Emit(serverError, ErrorResponse(serverError, "No turn assigned"))
+		return
+	}
+	rs, exists := info.Rooms.Get(room)
+	if exists && rs.MoveValidator != nil {
+		if problems := rs.MoveValidator.Validate(m); len(problems) > 0 {
+			log.Debug("Invalid move from", so.Id(), problems)
+			d := map[string]interface{}{}
+			d["error"] = "Invalid move"
+			d["problems"] = problems
+			metrics.Errors.Inc(clientError, "Invalid move")
+			so.Emit(clientError, WrapResponse(clientError, d))
+			return
+		}
+	}
+	strict := exists && rs.StrictTurns()
+	next := 0
+	if strict {
+		var ok bool
+		if next, ok = rs.TakeTurn(turn); !ok {
+			log.Debug("Move out of turn from", so.Id())
+			so.Emit(clientError, ErrorResponse(clientError, "Not your turn"))
+			return
+		}
+	}
+	// Overwrites who's turn it is using the turn map assigned at join.
+	m["madeBy"] = turn
+	m["madeById"] = PublicID(so, info)
+	if exists {
+		if name := rs.DisplayName(turn); name != "" {
+			m["madeByName"] = name
+		}
+	}
+	r := WrapResponse(moveMade, m)
+	log.Println(r)
+	info.Broadcaster.BroadcastTo(room, moveMade, r)
+	if exists {
+		metrics.Moves.Inc(rs.GameID)
+	}
+	if strict {
+		EmitTurnChanged(room, next, info)
+	}
+}
+
+// HandleRoomMessage is called when a player sends a chat message to their
+// room. The message is relayed to every member of the room with the sender's
+// turn and id attached.
+func HandleRoomMessage(so socketio.Socket, r MessageRequest, info Control) {
+	room, data, ok := chatMessage(so, r, info)
+	if !ok {
+		return
+	}
+	info.Broadcaster.BroadcastTo(room, roomMessage, WrapResponse(roomMessage, data))
+}
+
+// HandleDirectMessage is called when a player sends a chat message to a single
+// member of their room, identified by turn number.
+func HandleDirectMessage(so socketio.Socket, r MessageRequest, info Control) {
+	if r.To == nil {
+		so.Emit(clientError, ErrorResponse(clientError, "Must include to"))
+		return
+	}
+	room, data, ok := chatMessage(so, r, info)
+	if !ok {
+		return
+	}
+	var to domain.Player
+	if rs, exists := info.Rooms.Get(room); exists {
+		if seats := rs.Seats(); *r.To >= 0 && *r.To < len(seats) {
+			to = seats[*r.To]
+		}
+	}
+	if to.Comm == nil {
+		so.Emit(clientError, ErrorResponse(clientError, "No player with that turn number"))
+		return
+	}
+	data["to"] = *r.To
+	to.Comm.Emit(directMessage, WrapResponse(directMessage, data))
+}
+
+// HandleTeamMessage is called when a player sends a chat message to their
+// team. The message is relayed to every teammate still seated in the room,
+// the sender included, with the team attached.
+func HandleTeamMessage(so socketio.Socket, r MessageRequest, info Control) {
+	room, data, ok := chatMessage(so, r, info)
+	if !ok {
+		return
+	}
+	rs, exists := info.Rooms.Get(room)
+	if !exists || !rs.HasTeams() {
+		so.Emit(clientError, ErrorResponse(clientError, "Game has no teams"))
+		return
+	}
+	turn, _ := info.TurnMap.Get(TurnKey(so.Id(), room))
+	team := rs.Team(turn)
+	data["team"] = team
+	BroadcastToTeam(rs, team, teamMessage, WrapResponse(teamMessage, data))
+}
+
+// BroadcastToTeam emits the event to every player on the team that is still
+// seated in the room.
+func BroadcastToTeam(room *domain.Room, team int, event string, r Response) {
+	for _, p := range room.Teammates(team) {
+		p.Comm.Emit(event, r)
+	}
+}
+
+// chatMessage checks that the player is in a room and that the message is not
+// empty or too long, emitting a client error if it is not. It returns the
+// player's room and the message stamped with the sender's turn and id.
+func chatMessage(so socketio.Socket, r MessageRequest,
+	info Control) (string, map[string]interface{}, bool) {
+	room, exists := info.RoomMap.Get(so.Id())
+	if !exists {
+		log.Debug("No room assigned for", so.Id())
+		so.Emit(clientError, ErrorResponse(clientError, "Not in any Room"))
+		return "", nil, false
+	}
+	if r.Text == "" {
+		so.Emit(clientError, ErrorResponse(clientError, "Must include text"))
+		return "", nil, false
+	}
+	if utf8.RuneCountInString(r.Text) > info.MaxMessageLength {
+		so.Emit(clientError, ErrorResponse(clientError,
+			fmt.Sprintf("Message longer than %d characters", info.MaxMessageLength)))
+		return "", nil, false
+	}
+	turn, _ := info.TurnMap.Get(TurnKey(so.Id(), room))
+	data := map[string]interface{}{}
+	data["text"] = r.Text
+	data["sentBy"] = turn
+	data["sentById"] = PublicID(so, info)
+	return room, data, true
+}
+
+// HandleSetState is called when a player replaces the shared state document
+// of their room. The document must be a JSON object.
+func HandleSetState(so socketio.Socket, doc json.RawMessage, info Control) {
+	changeState(so, doc, info, (*domain.Room).ReplaceState)
+}
+
+// HandlePatchState is called when a player changes the shared state document
+// of their room with a JSON merge patch (RFC 7386).
+func HandlePatchState(so socketio.Socket, patch json.RawMessage, info Control) {
+	changeState(so, patch, info, (*domain.Room).PatchState)
+}
+
+// changeState decodes the raw JSON object, applies it to the player's room
+// with the given change and broadcasts the resulting state to the room.
+func changeState(so socketio.Socket, raw json.RawMessage, info Control,
+	change func(*domain.Room, map[string]interface{}) (json.RawMessage, int)) {
+	if _, watching := info.SpectatorMap.Get(so.Id()); watching {
+		so.Emit(clientError, ErrorResponse(clientError, "Spectators cannot change the state"))
+		return
+	}
+	rn, exists := info.RoomMap.Get(so.Id())
+	if !exists {
+		log.Debug("No room assigned for", so.Id())
+		so.Emit(serverError, ErrorResponse(serverError, "Not in any Room"))
+		return
+	}
+	room, exists := info.Rooms.Get(rn)
+	if !exists {
+		so.Emit(serverError, ErrorResponse(serverError, "Room has closed"))
+		return
+	}
+	doc := map[string]interface{}{}
+	if err := json.Unmarshal(raw, &doc); err != nil || doc == nil {
+		log.Debug("Invalid state from", so.Id(), string(raw))
+		so.Emit(clientError, ErrorResponse(clientError, "State must be a JSON object"))
+		return
+	}
+	turn, _ := info.TurnMap.Get(TurnKey(so.Id(), rn))
+	state, version := change(room, doc)
+	info.Broadcaster.BroadcastTo(rn, stateChanged, StateResponse(state, version, &turn))
+}
+
+// StateResponse wraps the shared state of a room in a state-changed response.
+// changedBy is the turn of the player that made the change, if there was one.
+func StateResponse(state json.RawMessage, version int, changedBy *int) Response {
+	data := map[string]interface{}{}
+	data["state"] = state
+	data["version"] = version
+	if changedBy != nil {
+		data["changedBy"] = *changedBy
+	}
+	return WrapResponse(stateChanged, data)
+}
+
+// StartServer loads the config and the games from the games directory (exits
+// on error) and keeps watching it for changes
+// Creates the socket io server and wraps it to accept the allowed origins
 // Initializes our Control structure to store metadata
 // and finally starts up the socket io server.
 func StartServer(c *cli.Context) {
-	games, err := ReadGameFiles("./games")
+	cfg, err := LoadConfig(c)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ConfigureLogging(cfg.Log)
+	gameDir := cfg.GamesDir
+	gm, err := ReadGameFiles(gameDir)
 	if err != nil {
 		log.Fatal(err)
 	}
-	for key, game := range games {
+	for key, game := range gm {
 		log.Println("Loaded:", key, "from", game.FileName)
 	}
+	games := domain.NewGameStore(gm)
 	server, err := socketio.NewServer(nil)
-	s := crossOriginServer{
-		Server: server,
-	}
 	if err != nil {
 		log.Fatal(err)
 	}
 	info := Control{
-		RoomMap: utils.NewConcurrentStringMap(),
-		TurnMap: utils.NewConcurrentStringIntMap(),
+		RoomMap:          utils.NewConcurrentStringMap(),
+		QueueMap:         utils.NewConcurrentStringMap(),
+		SpectatorMap:     utils.NewConcurrentStringMap(),
+		Matches:          domain.NewMatchStore(),
+		TurnMap:          utils.NewConcurrentStringIntMap(),
+		Sessions:         domain.NewSessionStore(),
+		ReconnectGrace:   cfg.Timeouts.ReconnectGrace.Duration,
+		PrivateRooms:     domain.NewPrivateRoomStore(),
+		Parties:          domain.NewPartyStore(),
+		Ratings:          domain.NewMemoryRatingStore(),
+		Players:          domain.NewMemoryPlayerStore(),
+		Identities:       utils.NewConcurrentStringMap(),
+		Users:            utils.NewConcurrentStringMap(),
+		Rooms:            domain.NewRoomStore(),
+		Broadcaster:      server,
+		MaxMessageLength: cfg.MaxMessageLength,
+		Drainer:          NewDrainer(),
+	}
+	if secret := cfg.Features.AuthSecret; secret != "" {
+		info.Auth = &Authenticator{Secret: []byte(secret)}
+		server.SetAllowRequest(info.Auth.AllowRequest)
+		log.Println("Connections must include a token")
+	}
+	if file := cfg.Features.PlayersFile; file != "" {
+		if info.Players, err = domain.NewFilePlayerStore(file); err != nil {
+			log.Fatal(err)
+		}
+		log.Println("Storing player profiles in", file)
+	}
+	if file := cfg.Features.RatingsFile; file != "" {
+		if info.Ratings, err = domain.NewFileRatingStore(file); err != nil {
+			log.Fatal(err)
+		}
+		log.Println("Storing ratings in", file)
+	}
+	if dir := cfg.Features.RecordDir; dir != "" {
+		if info.Recorder, err = NewRecorder(dir); err != nil {
+			log.Fatal(err)
+		}
+		info.Broadcaster = recordingBroadcaster{
+			Broadcaster: server,
+			Recorder:    info.Recorder,
+		}
+		log.Println("Recording rooms to", dir)
+	}
+	go FillGroups(games, info, time.Second)
+	if interval := cfg.Timeouts.ReloadInterval.Duration; interval > 0 {
+		go WatchGames(gameDir, games, info, interval)
 	}
 
 	server.On(connection, func(so socketio.Socket) {
 		log.Debug("Connection from", so.Id())
+		if !AuthenticateSocket(so, info) {
+			return
+		}
+		metrics.Sockets.Add(1)
 
 		// Makes it so that the player joins a room with his/her unique id.
 		so.Join(so.Id())
+		so.On(identify, func(r IdentifyRequest) {
+			HandleIdentify(so, r, info)
+		})
+
 		so.On(joinGame, func(r GameJoinRequest) {
 			HandlePlayerJoin(so, r, games, info)
 		})
 
+		so.On(rejoinRoom, func(r RejoinRequest) {
+			HandlePlayerRejoin(so, r, info)
+		})
+
+		so.On(createPrivateRoom, func(r GameJoinRequest) {
+			HandleCreatePrivateRoom(so, r, games, info)
+		})
+
+		so.On(joinPrivateRoom, func(r PrivateRoomRequest) {
+			HandleJoinPrivateRoom(so, r, games, info)
+		})
+
+		so.On(startPrivateRoom, func() {
+			HandleStartPrivateRoom(so, games, info)
+		})
+
 		so.On(disconnection, func() {
-			// This is really really bad unfuture proof, slow code.
-			// Please Refactor me
-			for key := range games {
-				g := games[key]
-				g.Lobby.Remove(so.Id())
+			metrics.Sockets.Add(-1)
+			DequeuePlayer(so.Id(), games, info)
+			StopSpectating(so.Id(), info)
+			LeaveParty(so.Id(), info)
+			info.Identities.Del(so.Id())
+			info.Users.Del(so.Id())
+			if pr, ok := info.PrivateRooms.Remove(so.Id()); ok {
+				EmitPrivateRoomUpdate(pr)
 			}
-			r, foundRoom := info.RoomMap.Get(so.Id())
-			tk := TurnKey(so.Id(), r)
-			t, foundTurn := info.TurnMap.Get(tk)
-			// Broadcast to the room that the player disconnected.
-			if foundRoom && foundTurn {
+			// Remove the player from the room and turn maps when they disconnect
+			// and broadcast to the room that the player disconnected.
+			if r, t, ok := RemoveFromRoom(so.Id(), info); ok {
 				m := map[string]interface{}{}
 				m["player"] = t
-				server.BroadcastTo(r, playerDisconnect, WrapResponse(playerDisconnect, m))
+				info.Broadcaster.BroadcastTo(r, playerDisconnect,
+					WrapResponse(playerDisconnect, m))
+				// Don't let the clock run out on a player who can't move.
+				if room, exists := info.Rooms.Get(r); exists && room.CurrentTurn() == t {
+					room.StopTurnTimer()
+				}
+			}
+			// Hold the player's seat so that it can be reclaimed with rejoin-room
+			// until the grace window runs out.
+			if s, ok := info.Sessions.Disconnect(so.Id(), time.Now()); ok {
+				time.AfterFunc(info.ReconnectGrace, func() {
+					if info.Sessions.Expire(s.Token, s.DisconnectedAt) {
+						log.Debug("Seat", s.Turn, "in", s.RoomName, "was not reclaimed")
+						ReleaseSeat(s.RoomName, s.Turn, info)
+					}
+				})
 			}
-			// Remove the player from the room and turn maps when they disconnect.
-			info.RoomMap.Del(so.Id())
-			info.TurnMap.Del(tk)
 		})
 
 		so.On(makeMove, func(move json.RawMessage) {
-			room, exists := info.RoomMap.Get(so.Id())
-			log.Println(string(move))
-			if exists {
-				m := map[string]interface{}{}
-				if err := json.Unmarshal(move, &m); err != nil {
-					log.Debug("Invalid JSON from", so.Id(), string(move))
-					so.Emit(clientError, ErrorResponse(clientError, "Invalid JSON"))
-				}
-				turn, exists := info.TurnMap.Get(room + ":" + so.Id())
-				if !exists {
-					log.Debug("No turn assigned", so.Id())
-					so.Emit(serverError, ErrorResponse(serverError, "No turn assigned"))
-				}
-				// Overwrites who's turn it is using the turn map assigned at join.
-				m["madeBy"] = turn
-				m["madeById"] = so.Id()
-				r := WrapResponse(moveMade, m)
-				log.Println(r)
-				server.BroadcastTo(room, moveMade, r)
-			} else {
-				log.Debug("No room assigned for", so.Id())
-				so.Emit(serverError, ErrorResponse(serverError, "Not in any Room"))
-			}
+			HandleMakeMove(so, move, info)
+		})
+
+		so.On(ready, func() {
+			HandleReady(so, games, info)
+		})
+
+		so.On(decline, func() {
+			HandleDecline(so, games, info)
+		})
+
+		so.On(spectateRoom, func(r SpectateRequest) {
+			HandleSpectateRoom(so, r, info)
+		})
+
+		so.On(createParty, func() {
+			HandleCreateParty(so, info)
+		})
+
+		so.On(inviteToParty, func(r PartyInviteRequest) {
+			HandleInviteToParty(so, r, info)
+		})
+
+		so.On(joinParty, func(r PartyJoinRequest) {
+			HandleJoinParty(so, r, info)
+		})
+
+		so.On(leaveParty, func() {
+			HandleLeaveParty(so, games, info)
+		})
+
+		so.On(reportResult, func(r ResultRequest) {
+			HandleReportResult(so, r, info)
+		})
+
+		so.On(leaveQueue, func() {
+			HandleLeaveQueue(so, games, info)
+		})
+
+		so.On(leaveRoom, func() {
+			HandleLeaveRoom(so, info)
+		})
+
+		so.On(setState, func(doc json.RawMessage) {
+			HandleSetState(so, doc, info)
+		})
+
+		so.On(patchState, func(patch json.RawMessage) {
+			HandlePatchState(so, patch, info)
+		})
+
+		so.On(roomMessage, func(r MessageRequest) {
+			HandleRoomMessage(so, r, info)
+		})
+
+		so.On(directMessage, func(r MessageRequest) {
+			HandleDirectMessage(so, r, info)
+		})
+
+		so.On(teamMessage, func(r MessageRequest) {
+			HandleTeamMessage(so, r, info)
 		})
 	})
 
-	port := c.String("port")
+	if token := cfg.Features.AdminToken; token != "" {
+		http.Handle("/admin/", adminServer{Token: token, Games: games, Info: info})
+		log.Println("Admin API enabled at /admin/")
+	}
+	if cfg.Features.Metrics {
+		http.Handle("/metrics", MetricsHandler(games, info))
+		log.Println("Metrics enabled at /metrics")
+	}
+	http.Handle("/socket.io/", newCORSServer(server, cfg.CORS.Origins, cfg.CORS.Dev))
+	http.Handle("/", http.FileServer(http.Dir(cfg.StaticDir)))
 
-	http.Handle("/socket.io/", s)
-	http.Handle("/", http.FileServer(http.Dir("./asset")))
-	log.Println("Serving at localhost:" + port)
-	log.Fatal(http.ListenAndServe(":"+port, nil))
+	tlsConfig, err := TLSConfig(cfg.TLS)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// The servers are kept so that they can be shut down once drained.
+	ln, err := Listen(cfg.Listen, tlsConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+	servers := []*http.Server{{}}
+	errs := make(chan error, 2)
+	go func() { errs <- servers[0].Serve(ln) }()
+	if tlsConfig == nil {
+		log.Println("Serving at " + cfg.Listen)
+	} else {
+		log.Println("Serving at https://" + cfg.Listen)
+	}
+	if redirect := cfg.TLS.RedirectPort; redirect != "" {
+		rl, err := net.Listen("tcp", ":"+redirect)
+		if err != nil {
+			log.Fatal(err)
+		}
+		rs := &http.Server{Handler: RedirectToHTTPS(cfg.Port())}
+		servers = append(servers, rs)
+		go func() { errs <- rs.Serve(rl) }()
+		log.Println("Redirecting port " + redirect + " to HTTPS")
+	}
+
+	stop := make(chan os.Signal, 2)
+	signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+	select {
+	case err := <-errs:
+		log.Fatal(err)
+	case sig := <-stop:
+		log.Println("Received", sig)
+	}
+	// A second signal stops the server without waiting for the rooms.
+	go func() {
+		<-stop
+		log.Fatal("Stopped before every room finished")
+	}()
+	DrainServer(games, info, cfg.Timeouts.ShutdownGrace.Duration, 100*time.Millisecond)
+	if cfg.Features.Metrics {
+		LogMetrics()
+	}
+	// Every room is closed by now, the requests still in flight only get a
+	// moment to finish before their connections are closed.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, s := range servers {
+		if err := s.Shutdown(ctx); err != nil {
+			log.Warn("Closing connections that did not finish: ", err)
+			s.Close()
+		}
+	}
+	log.Println("Server stopped")
 }
 
 // WrapResponse wraps the data we want to send in our response struct and adds
@@ -292,54 +1362,25 @@ func WrapResponse(kind string, data interface{}) Response {
 
 // ErrorResponse is a method for creating errors more quickly.
 // It takes the error string and then calls WrapResponse internally to wrap the
-// data
+// data. Every error is counted in the metrics by kind and message.
 func ErrorResponse(kind, err string) Response {
+	metrics.Errors.Inc(kind, err)
 	d := map[string]interface{}{}
 	d["error"] = err
 	return WrapResponse(kind, d)
 }
 
 // ReadGameFiles reads the provided directory for files that conform to the
-// game struct definition, these must be json files, and loads them into our
-// game map.
+// game struct definition, these must be toml files, and loads them into our
+// game map. It fails on the first problem that makes a game unusable while
+// other problems, like unknown keys, are only logged.
 func ReadGameFiles(gameDir string) (domain.GameMap, error) {
-	files, err := filepath.Glob(gameDir + "/*.toml")
-	if len(files) == 0 {
-		return nil, errors.New("Unable to find games. Does games directory exist?")
-	}
-
-	gm := domain.GameMap{}
-	if err != nil {
-		return nil, err
-	}
-	for _, f := range files {
-		raw, err := os.Open(f)
-		defer raw.Close()
-		if err != nil {
-			return nil, err
-		}
-		r := io.Reader(raw)
-		dummy := domain.Game{}
-		if meta, err := toml.DecodeReader(r, &dummy); err != nil {
-			log.Error(meta)
-			return nil, errors.New("Invalid configuration in file: " + f)
+	gm, problems := CheckGameFiles(gameDir)
+	for _, p := range problems {
+		if p.Fatal {
+			return nil, p
 		}
-		if dummy.MinPlayers == 0 {
-			return nil, errors.New("Invalid configuration in file: must provide minPlayers" + f)
-		}
-		g := domain.Game{
-			MinPlayers: dummy.MinPlayers,
-			MaxPlayers: dummy.MaxPlayers,
-			Title:      dummy.Title,
-			UUID:       dummy.UUID,
-			Lobby:      domain.NewLobby(),
-		}
-		g.FileName = f
-		if _, exists := gm[g.UUID]; exists {
-			return nil, errors.New("uniqueKey conflict between: " + f + " and " +
-				gm[g.UUID].FileName)
-		}
-		gm[g.UUID] = g
+		log.Warn(p)
 	}
 	return gm, nil
 }
@@ -355,12 +1396,162 @@ func main() {
 	app.Usage = "a server for creating quick prototype websocket based games."
 	app.Action = StartServer
 	app.Version = Version
+	app.Commands = []cli.Command{
+		{
+			Name:   "validate",
+			Usage:  "Check the game files in the games directory, or in [dir]",
+			Action: ValidateGames,
+		},
+		{
+			Name:  "config",
+			Usage: "Work with the server config",
+			Subcommands: []cli.Command{
+				{
+					Name:   "print",
+					Usage:  "Print the effective config, after flags and environment variables",
+					Action: PrintConfig,
+				},
+			},
+		},
+		{
+			Name:   "replay",
+			Usage:  "Serve a room recording over socket.io: replay <file>",
+			Action: Replay,
+			Flags: append([]cli.Flag{
+				cli.StringFlag{
+					Name:  "port, p",
+					Value: "3000",
+					Usage: "The port to run the replay server on",
+				},
+				cli.Float64Flag{
+					Name:  "speed",
+					Value: 1,
+					Usage: "How many times faster than the original to replay",
+				},
+				cli.IntFlag{
+					Name:  "turn",
+					Usage: "The turn number of the player whose point of view is replayed",
+				},
+			}, corsFlags...),
+		},
+	}
 	app.Flags = []cli.Flag{
+		cli.StringFlag{
+			Name:   "config",
+			Value:  defaultConfigFile,
+			Usage:  "The config file to read, it may be missing unless this is given",
+			EnvVar: "TOTO_CONFIG",
+		},
+		cli.StringFlag{
+			Name:   "listen",
+			Value:  ":3000",
+			Usage:  "The address to run the server on",
+			EnvVar: "TOTO_LISTEN",
+		},
 		cli.StringFlag{
 			Name:  "port, p",
 			Value: "3000",
-			Usage: "The port to run the server on",
+			Usage: "The port to run the server on, replacing the port of the listen address",
+		},
+		cli.StringFlag{
+			Name:   "games-dir",
+			Value:  "./games",
+			Usage:  "The directory the game files are loaded from",
+			EnvVar: "TOTO_GAMES_DIR",
+		},
+		cli.StringFlag{
+			Name:   "static-dir",
+			Value:  "./asset",
+			Usage:  "The directory of the static files served at /",
+			EnvVar: "TOTO_STATIC_DIR",
+		},
+		cli.StringFlag{
+			Name:   "log-level",
+			Value:  "debug",
+			Usage:  "The lowest level logged: panic, fatal, error, warn, info or debug",
+			EnvVar: "TOTO_LOG_LEVEL",
+		},
+		cli.StringFlag{
+			Name:   "log-format",
+			Value:  "text",
+			Usage:  "How logs are written: text or json",
+			EnvVar: "TOTO_LOG_FORMAT",
+		},
+		cli.DurationFlag{
+			Name:   "reconnect-grace",
+			Value:  30 * time.Second,
+			Usage:  "How long a disconnected player's seat is held for rejoin-room",
+			EnvVar: "TOTO_RECONNECT_GRACE",
+		},
+		cli.DurationFlag{
+			Name:   "shutdown-grace",
+			Value:  30 * time.Second,
+			Usage:  "How long rooms have to finish after SIGTERM before the server stops",
+			EnvVar: "TOTO_SHUTDOWN_GRACE",
+		},
+		cli.DurationFlag{
+			Name:   "reload-interval",
+			Value:  2 * time.Second,
+			Usage:  "How often the games directory is checked for changes, 0 disables reloading",
+			EnvVar: "TOTO_RELOAD_INTERVAL",
+		},
+		cli.StringFlag{
+			Name:   "tls-cert",
+			Usage:  "Serves HTTPS with this certificate file, reloaded on SIGHUP",
+			EnvVar: "TOTO_TLS_CERT",
+		},
+		cli.StringFlag{
+			Name:   "tls-key",
+			Usage:  "The key file of the certificate given with tls-cert",
+			EnvVar: "TOTO_TLS_KEY",
+		},
+		cli.BoolFlag{
+			Name:   "tls-self-signed",
+			Usage:  "Serves HTTPS with a self-signed certificate generated on startup, only meant for development",
+			EnvVar: "TOTO_TLS_SELF_SIGNED",
+		},
+		cli.StringFlag{
+			Name:   "redirect-port",
+			Usage:  "Also serves plain HTTP on this port, redirecting every request to HTTPS",
+			EnvVar: "TOTO_REDIRECT_PORT",
+		},
+		cli.StringFlag{
+			Name:   "admin-token",
+			Usage:  "Enables the admin API for requests that carry this token",
+			EnvVar: "TOTO_ADMIN_TOKEN",
+		},
+		cli.StringFlag{
+			Name:   "auth-secret",
+			Usage:  "Requires connections to include a JWT signed with this secret using HS256",
+			EnvVar: "TOTO_AUTH_SECRET",
+		},
+		cli.BoolFlag{
+			Name:   "metrics",
+			Usage:  "Serves metrics in the Prometheus text format at /metrics",
+			EnvVar: "TOTO_METRICS",
+		},
+		cli.StringFlag{
+			Name:   "record-dir",
+			Usage:  "Records the responses sent to each room to a JSONL file in this directory",
+			EnvVar: "TOTO_RECORD_DIR",
+		},
+		cli.StringFlag{
+			Name:   "players-file",
+			Usage:  "Keeps player profiles in this JSON file rather than in memory",
+			EnvVar: "TOTO_PLAYERS_FILE",
+		},
+		cli.StringFlag{
+			Name:   "ratings-file",
+			Usage:  "Keeps player ratings in this JSON file rather than in memory",
+			EnvVar: "TOTO_RATINGS_FILE",
+		},
+		cli.IntFlag{
+			Name:   "max-message-length",
+			Value:  500,
+			Usage:  "The maximum number of characters in a chat message",
+			EnvVar: "TOTO_MAX_MESSAGE_LENGTH",
 		},
 	}
+	app.Flags = append(app.Flags, corsFlags...)
 	app.Run(os.Args)
 }
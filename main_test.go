@@ -1,10 +1,19 @@
 package main
 
 import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/codegangsta/cli"
 	. "github.com/smartystreets/goconvey/convey"
 	"github.com/tiltfactor/toto/domain"
+	"github.com/tiltfactor/toto/utils"
 )
 
 type testComm struct {
@@ -39,6 +48,19 @@ func (t testComm) BroadcastTo(room, event string, args ...interface{}) error {
 	return nil
 }
 
+func (t testComm) Request() *http.Request {
+	return nil
+}
+
+// testBroadcaster records the events that are broadcast to rooms
+type testBroadcaster struct {
+	events *[]string
+}
+
+func (t testBroadcaster) BroadcastTo(room, event string, args ...interface{}) {
+	*t.events = append(*t.events, event)
+}
+
 func TestQueuePlayers(t *testing.T) {
 	Convey("Players should be added to the queue", t, func() {
 		Convey("When they are not already in the queue", func() {
@@ -67,40 +89,1500 @@ func TestQueuePlayers(t *testing.T) {
 	})
 }
 
-//
-// func TestGroupPlayers(t *testing.T) {
-// 	Convey("Players should be grouped", t, func() {
-// 		Convey("When the min number of players is available", func() {
-// 			g := domain.Game{
-// 				MinPlayers: 2
-// 				Lobby: domain.NewLobby(),
-// 			}
-// 			p := domain.Player{
-// 				Comm: testComm{
-// 					ID: "testID",
-// 				},
-// 			}
-// 			p2 := domain.Player{
-// 				Comm: testComm{
-// 					ID: "testID2",
-// 				},
-// 			}
-// 			QueuePlayers(g, p)
-// 			QueuePlayers(g, p2)
-// 			So(GroupPlayers(g, gi *GamesInfo))
-// 			So(QueuePlayers(g, p), ShouldBeTrue)
-// 		})
-// 		Convey("But not when they are already in the queue", func() {
-// 			g := domain.Game{
-// 				Lobby: domain.NewLobby(),
-// 			}
-// 			p := domain.Player{
-// 				Comm: testComm{
-// 					ID: "testID",
-// 				},
-// 			}
-// 			QueuePlayers(g, p)
-// 			So(QueuePlayers(g, p), ShouldBeFalse)
-// 		})
-// 	})
-// }
+func newTestControl() *Control {
+	return &Control{
+		RoomMap:      utils.NewConcurrentStringMap(),
+		QueueMap:     utils.NewConcurrentStringMap(),
+		SpectatorMap: utils.NewConcurrentStringMap(),
+		TurnMap:      utils.NewConcurrentStringIntMap(),
+		Rooms:        domain.NewRoomStore(),
+		Sessions:     domain.NewSessionStore(),
+		PrivateRooms: domain.NewPrivateRoomStore(),
+		Matches:      domain.NewMatchStore(),
+		Parties:      domain.NewPartyStore(),
+		Ratings:      domain.NewMemoryRatingStore(),
+		Players:      domain.NewMemoryPlayerStore(),
+		Identities:   utils.NewConcurrentStringMap(),
+		Users:        utils.NewConcurrentStringMap(),
+		Drainer:      NewDrainer(),
+	}
+}
+
+func queueTestPlayers(g domain.Game, ids ...string) {
+	for _, id := range ids {
+		QueuePlayers(g, domain.Player{
+			Comm: testComm{
+				ID: id,
+			},
+		})
+	}
+}
+
+func TestGroupPlayers(t *testing.T) {
+	Convey("Players should be grouped", t, func() {
+		Convey("When the max number of players is available", func() {
+			g := domain.Game{
+				MinPlayers: 2,
+				MaxPlayers: 3,
+				Lobby:      domain.NewLobby(),
+			}
+			gi := newTestControl()
+			queueTestPlayers(g, "testID", "testID2", "testID3")
+			rn, group := GroupPlayers(g, gi)
+			So(rn, ShouldNotBeEmpty)
+			So(len(group), ShouldEqual, 3)
+			So(g.Lobby.Size(), ShouldEqual, 0)
+			room, _ := gi.RoomMap.Get("testID2")
+			So(room, ShouldEqual, rn)
+			turn, _ := gi.TurnMap.Get(TurnKey("testID2", rn))
+			So(turn, ShouldEqual, 1)
+		})
+		Convey("When the fill timeout has elapsed for the oldest player", func() {
+			g := domain.Game{
+				MinPlayers:  2,
+				MaxPlayers:  4,
+				FillTimeout: 1,
+				Lobby:       domain.NewLobby(),
+			}
+			queueTestPlayers(g, "testID", "testID2")
+			time.Sleep(g.FillWait())
+			_, group := GroupPlayers(g, newTestControl())
+			So(len(group), ShouldEqual, 2)
+		})
+	})
+	Convey("Players should not be grouped", t, func() {
+		Convey("When fewer than max are queued and there is no fill timeout", func() {
+			g := domain.Game{
+				MinPlayers: 2,
+				MaxPlayers: 4,
+				Lobby:      domain.NewLobby(),
+			}
+			queueTestPlayers(g, "testID", "testID2", "testID3")
+			rn, group := GroupPlayers(g, newTestControl())
+			So(rn, ShouldBeEmpty)
+			So(group, ShouldBeNil)
+			So(g.Lobby.Size(), ShouldEqual, 3)
+		})
+		Convey("When the fill timeout elapsed but fewer than min are queued", func() {
+			g := domain.Game{
+				MinPlayers:  2,
+				MaxPlayers:  4,
+				FillTimeout: 1,
+				Lobby:       domain.NewLobby(),
+			}
+			queueTestPlayers(g, "testID")
+			time.Sleep(g.FillWait())
+			_, group := GroupPlayers(g, newTestControl())
+			So(group, ShouldBeNil)
+		})
+	})
+}
+
+func TestRejoin(t *testing.T) {
+	Convey("Players who dropped", t, func() {
+		g := domain.Game{
+			UUID:       "test-game",
+			MinPlayers: 2,
+			MaxPlayers: 2,
+			Lobby:      domain.NewLobby(),
+		}
+		events := []string{}
+		gi := newTestControl()
+		gi.Broadcaster = testBroadcaster{events: &events}
+		gi.ReconnectGrace = time.Minute
+		queueTestPlayers(g, "testID", "testID2")
+		rn, group := GroupPlayers(g, gi)
+		AnnounceGroup(rn, group, *gi)
+		RemoveFromRoom("testID", *gi)
+		s, _ := gi.Sessions.Disconnect("testID", time.Now())
+		emitted := []string{}
+		p := emittingComm{testComm: testComm{ID: "newID"}, events: &emitted}
+
+		Convey("Should reclaim their seat within the grace window", func() {
+			HandlePlayerRejoin(p, RejoinRequest{ResumeToken: s.Token}, *gi)
+			So(emitted, ShouldResemble, []string{groupAssignment})
+			room, _ := gi.RoomMap.Get("newID")
+			So(room, ShouldEqual, rn)
+			turn, _ := gi.TurnMap.Get(TurnKey("newID", rn))
+			So(turn, ShouldEqual, 0)
+			r, _ := gi.Rooms.Get(rn)
+			So(r.Seats()[0].Comm.Id(), ShouldEqual, "newID")
+		})
+		Convey("Should not reclaim a seat that was released", func() {
+			So(gi.Sessions.Expire(s.Token, s.DisconnectedAt), ShouldBeTrue)
+			ReleaseSeat(rn, s.Turn, *gi)
+			HandlePlayerRejoin(p, RejoinRequest{ResumeToken: s.Token}, *gi)
+			So(emitted, ShouldResemble, []string{clientError})
+			_, inRoom := gi.RoomMap.Get("newID")
+			So(inRoom, ShouldBeFalse)
+			r, _ := gi.Rooms.Get(rn)
+			So(r.Seats()[0].Comm, ShouldBeNil)
+		})
+		Convey("Should not reclaim a seat while spectating", func() {
+			HandleSpectateRoom(p, SpectateRequest{RoomName: rn}, *gi)
+			HandlePlayerRejoin(p, RejoinRequest{ResumeToken: s.Token}, *gi)
+			So(emitted, ShouldResemble, []string{spectating, clientError})
+			_, inRoom := gi.RoomMap.Get("newID")
+			So(inRoom, ShouldBeFalse)
+			_, watching := gi.SpectatorMap.Get("newID")
+			So(watching, ShouldBeTrue)
+			_, valid := gi.Sessions.Get(s.Token)
+			So(valid, ShouldBeTrue)
+		})
+		Convey("Should not reclaim a seat while queued", func() {
+			games := domain.NewGameStore(domain.GameMap{g.UUID: g})
+			HandlePlayerJoin(p, GameJoinRequest{GameID: g.UUID}, games, *gi)
+			HandlePlayerRejoin(p, RejoinRequest{ResumeToken: s.Token}, *gi)
+			So(emitted, ShouldResemble, []string{inQueue, clientError})
+			_, inRoom := gi.RoomMap.Get("newID")
+			So(inRoom, ShouldBeFalse)
+			_, queued := gi.QueueMap.Get("newID")
+			So(queued, ShouldBeTrue)
+			So(g.Lobby.Size(), ShouldEqual, 1)
+		})
+		Convey("Should not reclaim a seat with an unknown token", func() {
+			HandlePlayerRejoin(p, RejoinRequest{ResumeToken: "nope"}, *gi)
+			So(emitted, ShouldResemble, []string{clientError})
+		})
+	})
+}
+
+func TestPrivateRooms(t *testing.T) {
+	Convey("Private rooms", t, func() {
+		g := domain.Game{
+			UUID:       "test-game",
+			MinPlayers: 2,
+			MaxPlayers: 3,
+			Lobby:      domain.NewLobby(),
+		}
+		games := domain.NewGameStore(domain.GameMap{g.UUID: g})
+		gi := newTestControl()
+		emitted := map[string]*[]string{}
+		players := []emittingComm{}
+		for _, id := range []string{"host", "guest", "guest2"} {
+			emitted[id] = &[]string{}
+			players = append(players, emittingComm{
+				testComm: testComm{ID: id},
+				events:   emitted[id],
+			})
+		}
+		HandleCreatePrivateRoom(players[0], GameJoinRequest{GameID: g.UUID}, games, *gi)
+		pr, _ := gi.PrivateRooms.ByPlayer("host")
+
+		Convey("Should be created with a code and their host", func() {
+			So(pr.Code, ShouldNotBeEmpty)
+			So(pr.Host, ShouldEqual, "host")
+			So(*emitted["host"], ShouldResemble, []string{privateRoomUpdate})
+		})
+		Convey("Should be joined with their code", func() {
+			HandleJoinPrivateRoom(players[1], PrivateRoomRequest{Code: pr.Code}, games, *gi)
+			joined, _ := gi.PrivateRooms.ByPlayer("guest")
+			So(joined.Code, ShouldEqual, pr.Code)
+			So(len(joined.Players), ShouldEqual, 2)
+			So(*emitted["host"], ShouldResemble, []string{privateRoomUpdate, privateRoomUpdate})
+
+			HandleJoinPrivateRoom(players[2], PrivateRoomRequest{Code: "nope"}, games, *gi)
+			So(*emitted["guest2"], ShouldResemble, []string{clientError})
+		})
+		Convey("Should be discarded if their game was removed", func() {
+			HandleJoinPrivateRoom(players[1], PrivateRoomRequest{Code: pr.Code}, games, *gi)
+			games.Del(g.UUID)
+			HandleStartPrivateRoom(players[0], games, *gi)
+			So(*emitted["host"], ShouldResemble,
+				[]string{privateRoomUpdate, privateRoomUpdate, clientError})
+			So(*emitted["guest"], ShouldResemble, []string{privateRoomUpdate, clientError})
+			_, inRoom := gi.RoomMap.Get("host")
+			So(inRoom, ShouldBeFalse)
+			_, waiting := gi.PrivateRooms.ByPlayer("guest")
+			So(waiting, ShouldBeFalse)
+		})
+		Convey("Should start once the host asks and there are enough players", func() {
+			HandleStartPrivateRoom(players[0], games, *gi)
+			So(*emitted["host"], ShouldResemble, []string{privateRoomUpdate, clientError})
+
+			HandleJoinPrivateRoom(players[1], PrivateRoomRequest{Code: pr.Code}, games, *gi)
+			HandleStartPrivateRoom(players[1], games, *gi)
+			So(*emitted["guest"], ShouldResemble, []string{privateRoomUpdate, clientError})
+
+			HandleStartPrivateRoom(players[0], games, *gi)
+			host, _ := gi.RoomMap.Get("host")
+			guest, _ := gi.RoomMap.Get("guest")
+			So(host, ShouldNotBeEmpty)
+			So(guest, ShouldEqual, host)
+			turn, _ := gi.TurnMap.Get(TurnKey("guest", host))
+			So(turn, ShouldEqual, 1)
+			_, waiting := gi.PrivateRooms.ByPlayer("host")
+			So(waiting, ShouldBeFalse)
+		})
+		Convey("Should start on their own once they are full", func() {
+			HandleJoinPrivateRoom(players[1], PrivateRoomRequest{Code: pr.Code}, games, *gi)
+			HandleJoinPrivateRoom(players[2], PrivateRoomRequest{Code: pr.Code}, games, *gi)
+			_, inRoom := gi.RoomMap.Get("guest2")
+			So(inRoom, ShouldBeTrue)
+		})
+		Convey("Should pass the host on when the host leaves", func() {
+			HandleJoinPrivateRoom(players[1], PrivateRoomRequest{Code: pr.Code}, games, *gi)
+			HandleLeaveRoom(players[0], *gi)
+			left, _ := gi.PrivateRooms.ByPlayer("guest")
+			So(left.Host, ShouldEqual, "guest")
+			So(len(left.Players), ShouldEqual, 1)
+			_, waiting := gi.PrivateRooms.ByPlayer("host")
+			So(waiting, ShouldBeFalse)
+
+			HandleLeaveRoom(players[1], *gi)
+			HandleJoinPrivateRoom(players[2], PrivateRoomRequest{Code: pr.Code}, games, *gi)
+			So(*emitted["guest2"], ShouldResemble, []string{clientError})
+		})
+		Convey("Should not let their players queue for a game", func() {
+			HandlePlayerJoin(players[0], GameJoinRequest{GameID: g.UUID}, games, *gi)
+			So(*emitted["host"], ShouldResemble, []string{privateRoomUpdate, clientError})
+			So(g.Lobby.Contains("host"), ShouldBeFalse)
+			_, queued := gi.QueueMap.Get("host")
+			So(queued, ShouldBeFalse)
+		})
+	})
+}
+
+func TestStrictTurns(t *testing.T) {
+	Convey("In a room with strict turns", t, func() {
+		g := domain.Game{
+			MinPlayers: 2,
+			TurnMode:   domain.TurnModeStrict,
+			Lobby:      domain.NewLobby(),
+		}
+		events := []string{}
+		gi := newTestControl()
+		gi.Broadcaster = testBroadcaster{events: &events}
+		queueTestPlayers(g, "testID", "testID2")
+		rn, _ := GroupPlayers(g, gi)
+		room, _ := gi.Rooms.Get(rn)
+		move := json.RawMessage(`{"clicks": 1}`)
+
+		Convey("Moves made out of turn should be rejected", func() {
+			HandleMakeMove(testComm{ID: "testID2"}, move, *gi)
+			So(events, ShouldBeEmpty)
+			So(room.CurrentTurn(), ShouldEqual, 0)
+		})
+		Convey("Moves made in turn should advance the turn", func() {
+			HandleMakeMove(testComm{ID: "testID"}, move, *gi)
+			So(events, ShouldResemble, []string{moveMade, turnChanged})
+			So(room.CurrentTurn(), ShouldEqual, 1)
+		})
+		Convey("Vacated seats should be skipped", func() {
+			ReleaseSeat(rn, 1, *gi)
+			HandleMakeMove(testComm{ID: "testID"}, move, *gi)
+			So(room.CurrentTurn(), ShouldEqual, 0)
+		})
+	})
+}
+
+func TestTurnTimeouts(t *testing.T) {
+	Convey("When a turn times out", t, func() {
+		g := domain.Game{
+			MinPlayers: 2,
+			TurnMode:   domain.TurnModeStrict,
+			Lobby:      domain.NewLobby(),
+		}
+		events := []string{}
+		gi := newTestControl()
+		gi.Broadcaster = testBroadcaster{events: &events}
+
+		Convey("The turn should pass on by default", func() {
+			queueTestPlayers(g, "testID", "testID2")
+			rn, _ := GroupPlayers(g, gi)
+			room, _ := gi.Rooms.Get(rn)
+			HandleTurnTimeout(rn, 0, *gi)
+			So(events, ShouldResemble, []string{turnTimeout, turnChanged})
+			So(room.CurrentTurn(), ShouldEqual, 1)
+		})
+		Convey("The room should close with the end policy", func() {
+			g.TurnTimeoutPolicy = domain.TimeoutPolicyEnd
+			queueTestPlayers(g, "testID", "testID2")
+			rn, _ := GroupPlayers(g, gi)
+			HandleTurnTimeout(rn, 0, *gi)
+			So(events, ShouldResemble, []string{turnTimeout, roomClosed})
+			_, exists := gi.Rooms.Get(rn)
+			So(exists, ShouldBeFalse)
+			_, inRoom := gi.RoomMap.Get("testID2")
+			So(inRoom, ShouldBeFalse)
+		})
+	})
+}
+
+func TestRoomMessages(t *testing.T) {
+	Convey("Chat messages sent to a room", t, func() {
+		g := domain.Game{
+			MinPlayers: 2,
+			Lobby:      domain.NewLobby(),
+		}
+		events := []string{}
+		gi := newTestControl()
+		gi.Broadcaster = testBroadcaster{events: &events}
+		gi.MaxMessageLength = 5
+		queueTestPlayers(g, "testID", "testID2")
+		GroupPlayers(g, gi)
+
+		Convey("Should be broadcast when they fit the max length", func() {
+			HandleRoomMessage(testComm{ID: "testID"}, MessageRequest{Text: "hello"}, *gi)
+			So(events, ShouldResemble, []string{roomMessage})
+		})
+		Convey("Should be dropped when they are too long", func() {
+			HandleRoomMessage(testComm{ID: "testID"}, MessageRequest{Text: "hello!"}, *gi)
+			So(events, ShouldBeEmpty)
+		})
+		Convey("Should be dropped when the sender is not in a room", func() {
+			HandleRoomMessage(testComm{ID: "testID3"}, MessageRequest{Text: "hi"}, *gi)
+			So(events, ShouldBeEmpty)
+		})
+	})
+}
+
+func TestLeaving(t *testing.T) {
+	Convey("Players should be able to leave", t, func() {
+		g := domain.Game{
+			UUID:       "test-game",
+			MinPlayers: 3,
+			Lobby:      domain.NewLobby(),
+		}
+		games := domain.NewGameStore(domain.GameMap{g.UUID: g})
+		events := []string{}
+		gi := newTestControl()
+		gi.Broadcaster = testBroadcaster{events: &events}
+
+		Convey("The queue they are waiting in", func() {
+			p := testComm{ID: "testID"}
+			HandlePlayerJoin(p, GameJoinRequest{GameID: g.UUID}, games, *gi)
+			So(g.Lobby.Contains(p.ID), ShouldBeTrue)
+			HandleLeaveQueue(p, games, *gi)
+			So(g.Lobby.Contains(p.ID), ShouldBeFalse)
+			_, queued := gi.QueueMap.Get(p.ID)
+			So(queued, ShouldBeFalse)
+		})
+		Convey("The room they are in", func() {
+			queueTestPlayers(g, "testID", "testID2", "testID3")
+			rn, _ := GroupPlayers(g, gi)
+			HandleLeaveRoom(testComm{ID: "testID2"}, *gi)
+			So(events, ShouldResemble, []string{playerLeft})
+			_, inRoom := gi.RoomMap.Get("testID2")
+			So(inRoom, ShouldBeFalse)
+			room, _ := gi.Rooms.Get(rn)
+			So(room.Seats()[1].Comm, ShouldBeNil)
+		})
+	})
+}
+
+func TestSharedState(t *testing.T) {
+	Convey("The shared state of a room", t, func() {
+		g := domain.Game{
+			MinPlayers: 2,
+			Lobby:      domain.NewLobby(),
+		}
+		events := []string{}
+		gi := newTestControl()
+		gi.Broadcaster = testBroadcaster{events: &events}
+		queueTestPlayers(g, "testID", "testID2")
+		rn, _ := GroupPlayers(g, gi)
+		room, _ := gi.Rooms.Get(rn)
+		p := testComm{ID: "testID"}
+
+		Convey("Should be replaced by set-state", func() {
+			HandleSetState(p, json.RawMessage(`{"a": 1}`), *gi)
+			state, version := room.State()
+			So(string(state), ShouldEqual, `{"a":1}`)
+			So(version, ShouldEqual, 1)
+			So(events, ShouldResemble, []string{stateChanged})
+		})
+		Convey("Should be merged with patch-state", func() {
+			HandleSetState(p, json.RawMessage(`{"a": 1, "b": {"c": 2}}`), *gi)
+			HandlePatchState(p, json.RawMessage(`{"b": {"c": null, "d": 3}}`), *gi)
+			state, version := room.State()
+			So(string(state), ShouldEqual, `{"a":1,"b":{"d":3}}`)
+			So(version, ShouldEqual, 2)
+		})
+		Convey("Should only accept JSON objects", func() {
+			HandlePatchState(p, json.RawMessage(`[1, 2]`), *gi)
+			_, version := room.State()
+			So(version, ShouldEqual, 0)
+			So(events, ShouldBeEmpty)
+		})
+	})
+}
+
+func TestMoveSchema(t *testing.T) {
+	Convey("In a game with a move schema", t, func() {
+		schema, err := utils.CompileSchema([]byte(`{
+			"type": "object",
+			"required": ["clicks"],
+			"properties": {"clicks": {"type": "integer", "minimum": 1}}
+		}`))
+		So(err, ShouldBeNil)
+		g := domain.Game{
+			MinPlayers:    2,
+			MoveValidator: schema,
+			Lobby:         domain.NewLobby(),
+		}
+		events := []string{}
+		gi := newTestControl()
+		gi.Broadcaster = testBroadcaster{events: &events}
+		queueTestPlayers(g, "testID", "testID2")
+		GroupPlayers(g, gi)
+
+		Convey("Valid moves should be relayed", func() {
+			HandleMakeMove(testComm{ID: "testID"}, json.RawMessage(`{"clicks": 2}`), *gi)
+			So(events, ShouldResemble, []string{moveMade})
+		})
+		Convey("Invalid moves should be rejected with their failing paths", func() {
+			var move interface{}
+			json.Unmarshal([]byte(`{"clicks": 0.5}`), &move)
+			problems := schema.Validate(move)
+			So(len(problems), ShouldEqual, 1)
+			So(problems[0].Path, ShouldEqual, "/clicks")
+			HandleMakeMove(testComm{ID: "testID"}, json.RawMessage(`{"clicks": 0.5}`), *gi)
+			So(events, ShouldBeEmpty)
+		})
+	})
+}
+
+func TestReloadGames(t *testing.T) {
+	Convey("When the games are reloaded", t, func() {
+		g := domain.Game{
+			UUID:       "test-game",
+			Title:      "Test",
+			MinPlayers: 3,
+			Lobby:      domain.NewLobby(),
+		}
+		games := domain.NewGameStore(domain.GameMap{g.UUID: g})
+		gi := newTestControl()
+		p := testComm{ID: "testID"}
+		HandlePlayerJoin(p, GameJoinRequest{GameID: g.UUID}, games, *gi)
+
+		Convey("Existing games should be updated but keep their lobby", func() {
+			updated := g
+			updated.Title = "Updated"
+			updated.Lobby = domain.NewLobby()
+			changes := ReloadGames(games, domain.GameMap{g.UUID: updated}, *gi)
+			So(changes, ShouldResemble, []string{
+				"Updated game: test-game displayTitle: Test -> Updated",
+			})
+			reloaded, _ := games.Get(g.UUID)
+			So(reloaded.Title, ShouldEqual, "Updated")
+			So(reloaded.Lobby.Contains(p.ID), ShouldBeTrue)
+		})
+		Convey("Removed games should be retired", func() {
+			ReloadGames(games, domain.GameMap{}, *gi)
+			_, playable := games.Playable(g.UUID)
+			So(playable, ShouldBeFalse)
+			So(g.Lobby.Size(), ShouldEqual, 0)
+			_, queued := gi.QueueMap.Get(p.ID)
+			So(queued, ShouldBeFalse)
+		})
+	})
+}
+
+func TestCheckGameFiles(t *testing.T) {
+	Convey("When the game files are checked", t, func() {
+		dir, _ := ioutil.TempDir("", "toto-games")
+		defer os.RemoveAll(dir)
+		write := func(name, content string) {
+			ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644)
+		}
+		write("good.toml", "minPlayers = 2\ndisplayTitle = \"Good\"\n"+
+			"uniqueKey = \"good\"\n")
+
+		Convey("Valid games should be loaded without problems", func() {
+			gm, problems := CheckGameFiles(dir)
+			So(problems, ShouldBeEmpty)
+			So(gm, ShouldContainKey, "good")
+		})
+		Convey("Every problem should be reported", func() {
+			write("bad.toml", "minPlayers = 3\nmaxPlayers = 2\n"+
+				"playersInGroup = 2\ndisplayTitle = \"Bad\"\nuniqueKey = \"good\"\n")
+			gm, problems := CheckGameFiles(dir)
+			bad := filepath.Join(dir, "bad.toml")
+			So(problems, ShouldResemble, []GameProblem{
+				{File: bad, Key: "playersInGroup", Message: "unknown key"},
+				{File: bad, Key: "maxPlayers",
+					Message: "must not be less than minPlayers (3)", Fatal: true},
+			})
+			So(gm, ShouldContainKey, "good")
+		})
+		Convey("Conflicting unique keys should be reported", func() {
+			write("copy.toml", "minPlayers = 2\ndisplayTitle = \"Copy\"\n"+
+				"uniqueKey = \"good\"\n")
+			_, problems := CheckGameFiles(dir)
+			So(len(problems), ShouldEqual, 1)
+			So(problems[0].Key, ShouldEqual, "uniqueKey")
+			So(problems[0].Fatal, ShouldBeTrue)
+		})
+		Convey("A missing title should only be a warning", func() {
+			write("untitled.toml", "minPlayers = 2\nuniqueKey = \"untitled\"\n")
+			gm, problems := CheckGameFiles(dir)
+			So(problems, ShouldResemble, []GameProblem{{
+				File:    filepath.Join(dir, "untitled.toml"),
+				Key:     "displayTitle",
+				Message: "should be provided",
+			}})
+			So(gm, ShouldContainKey, "untitled")
+		})
+	})
+}
+
+func TestAdminAPI(t *testing.T) {
+	Convey("The admin API", t, func() {
+		g := domain.Game{
+			UUID:       "test-game",
+			MinPlayers: 2,
+			MaxPlayers: 2,
+			Lobby:      domain.NewLobby(),
+		}
+		games := domain.NewGameStore(domain.GameMap{g.UUID: g})
+		events := []string{}
+		gi := newTestControl()
+		gi.Broadcaster = testBroadcaster{events: &events}
+		admin := adminServer{Token: "secret", Games: games, Info: *gi}
+		request := func(method, path string) *httptest.ResponseRecorder {
+			r, _ := http.NewRequest(method, path, nil)
+			r.Header.Set("Authorization", "Bearer secret")
+			w := httptest.NewRecorder()
+			admin.ServeHTTP(w, r)
+			return w
+		}
+
+		Convey("Should reject requests without the admin token", func() {
+			r, _ := http.NewRequest("GET", "/admin/games", nil)
+			w := httptest.NewRecorder()
+			admin.ServeHTTP(w, r)
+			So(w.Code, ShouldEqual, http.StatusUnauthorized)
+		})
+		Convey("Should list the games and their queued players", func() {
+			queueTestPlayers(g, "testID")
+			list := []AdminGame{}
+			w := request("GET", "/admin/games")
+			json.Unmarshal(w.Body.Bytes(), &list)
+			So(w.Code, ShouldEqual, http.StatusOK)
+			So(len(list), ShouldEqual, 1)
+			So(list[0].Queue[0].ID, ShouldEqual, "testID")
+		})
+		Convey("Should list the rooms and their seats", func() {
+			queueTestPlayers(g, "testID", "testID2")
+			rn, _ := GroupPlayers(g, gi)
+			list := []AdminRoom{}
+			json.Unmarshal(request("GET", "/admin/rooms").Body.Bytes(), &list)
+			So(len(list), ShouldEqual, 1)
+			So(list[0].Name, ShouldEqual, rn)
+			So(list[0].Seats, ShouldResemble, []AdminSeat{
+				{Turn: 0, ID: "testID", Connected: true},
+				{Turn: 1, ID: "testID2", Connected: true},
+			})
+		})
+		Convey("Should close rooms", func() {
+			queueTestPlayers(g, "testID", "testID2")
+			rn, _ := GroupPlayers(g, gi)
+			w := request("POST", "/admin/rooms/"+rn+"/close")
+			So(w.Code, ShouldEqual, http.StatusNoContent)
+			_, exists := gi.Rooms.Get(rn)
+			So(exists, ShouldBeFalse)
+			So(request("POST", "/admin/rooms/"+rn+"/close").Code,
+				ShouldEqual, http.StatusNotFound)
+		})
+		Convey("Should kick players", func() {
+			queueTestPlayers(g, "testID", "testID2")
+			rn, _ := GroupPlayers(g, gi)
+			w := request("POST", "/admin/players/testID2/kick")
+			So(w.Code, ShouldEqual, http.StatusNoContent)
+			So(events, ShouldResemble, []string{playerLeft, kicked})
+			room, _ := gi.Rooms.Get(rn)
+			So(room.Seats()[1].Comm, ShouldBeNil)
+			So(request("POST", "/admin/players/testID2/kick").Code,
+				ShouldEqual, http.StatusNotFound)
+		})
+	})
+}
+
+func TestMetrics(t *testing.T) {
+	Convey("The metrics endpoint", t, func() {
+		g := domain.Game{
+			UUID:       "metrics-game",
+			MinPlayers: 2,
+			Lobby:      domain.NewLobby(),
+		}
+		games := domain.NewGameStore(domain.GameMap{g.UUID: g})
+		gi := newTestControl()
+		scrape := func() string {
+			r, _ := http.NewRequest("GET", "/metrics", nil)
+			w := httptest.NewRecorder()
+			MetricsHandler(games, *gi).ServeHTTP(w, r)
+			return w.Body.String()
+		}
+
+		Convey("Should report the length of each queue", func() {
+			queueTestPlayers(g, "testID")
+			So(scrape(), ShouldContainSubstring,
+				`toto_queue_length{game="metrics-game"} 1`)
+		})
+		// The counters are global so they are compared with their value
+		// before each action rather than with an absolute one.
+		Convey("Should report rooms and the time players waited for them", func() {
+			created := metrics.RoomsCreated.Get(g.UUID)
+			waited := metrics.QueueWait.Count(g.UUID)
+			queueTestPlayers(g, "testID", "testID2")
+			GroupPlayers(g, gi)
+			So(metrics.RoomsCreated.Get(g.UUID)-created, ShouldEqual, 1.0)
+			So(metrics.QueueWait.Count(g.UUID)-waited, ShouldEqual, uint64(2))
+			body := scrape()
+			So(body, ShouldContainSubstring,
+				`toto_rooms_created_total{game="metrics-game"} `)
+			So(body, ShouldContainSubstring,
+				`toto_rooms_active{game="metrics-game"} 1`)
+			So(body, ShouldContainSubstring,
+				`toto_queue_wait_seconds_count{game="metrics-game"} `)
+		})
+		Convey("Should count errors by message", func() {
+			counted := metrics.Errors.Get(clientError, "Metrics test")
+			ErrorResponse(clientError, "Metrics test")
+			So(metrics.Errors.Get(clientError, "Metrics test")-counted, ShouldEqual, 1.0)
+			So(scrape(), ShouldContainSubstring,
+				`toto_errors_total{kind="client-error",message="Metrics test"} `)
+		})
+	})
+}
+
+// emittingComm records the events that are emitted to it
+type emittingComm struct {
+	testComm
+	events *[]string
+}
+
+func (e emittingComm) Emit(event string, args ...interface{}) error {
+	*e.events = append(*e.events, event)
+	return nil
+}
+
+func TestRecording(t *testing.T) {
+	Convey("Rooms that are recorded", t, func() {
+		dir, _ := ioutil.TempDir("", "toto-recordings")
+		defer os.RemoveAll(dir)
+		g := domain.Game{
+			UUID:       "test-game",
+			MinPlayers: 2,
+			Lobby:      domain.NewLobby(),
+		}
+		events := []string{}
+		gi := newTestControl()
+		gi.Recorder, _ = NewRecorder(dir)
+		gi.Broadcaster = recordingBroadcaster{
+			Broadcaster: testBroadcaster{events: &events},
+			Recorder:    gi.Recorder,
+		}
+		queueTestPlayers(g, "testID", "testID2")
+		rn, group := GroupPlayers(g, gi)
+		AnnounceGroup(rn, group, *gi)
+		HandleMakeMove(testComm{ID: "testID"}, json.RawMessage(`{"x":1}`), *gi)
+		CloseRoom(rn, "Game over", *gi)
+		recorded, err := ReadRecording(filepath.Join(dir, rn+".jsonl"))
+
+		Convey("Should have every response sent to the room in order", func() {
+			So(err, ShouldBeNil)
+			kinds := []string{}
+			for _, e := range recorded {
+				So(e.Room, ShouldEqual, rn)
+				kinds = append(kinds, e.Event)
+			}
+			So(kinds, ShouldResemble, []string{
+				groupAssignment, groupAssignment, moveMade, roomClosed,
+			})
+			So(*recorded[1].To, ShouldEqual, 1)
+			So(recorded[2].To, ShouldBeNil)
+		})
+		Convey("Should not give away resume tokens", func() {
+			data := recorded[0].Response.Data.(map[string]interface{})
+			So(data, ShouldNotContainKey, "resumeToken")
+		})
+		Convey("Should be replayed from the point of view of a turn", func() {
+			replayed := []string{}
+			p := emittingComm{testComm: testComm{ID: "viewer"}, events: &replayed}
+			ReplayEvents(p, recorded, 1, 1000, make(chan struct{}))
+			So(replayed, ShouldResemble, []string{
+				groupAssignment, moveMade, roomClosed,
+			})
+		})
+	})
+}
+
+func TestSpectators(t *testing.T) {
+	Convey("Spectators", t, func() {
+		g := domain.Game{
+			UUID:          "test-game",
+			MinPlayers:    2,
+			MaxSpectators: 1,
+			Lobby:         domain.NewLobby(),
+		}
+		events := []string{}
+		gi := newTestControl()
+		gi.Broadcaster = testBroadcaster{events: &events}
+		queueTestPlayers(g, "testID", "testID2")
+		rn, _ := GroupPlayers(g, gi)
+		room, _ := gi.Rooms.Get(rn)
+		emitted := []string{}
+		watcher := emittingComm{testComm: testComm{ID: "watcher"}, events: &emitted}
+		HandleSpectateRoom(watcher, SpectateRequest{RoomName: rn}, *gi)
+
+		Convey("Should join the room without a turn", func() {
+			So(emitted, ShouldResemble, []string{spectating})
+			So(len(room.Spectators()), ShouldEqual, 1)
+			_, hasTurn := gi.TurnMap.Get(TurnKey(watcher.ID, rn))
+			So(hasTurn, ShouldBeFalse)
+		})
+		Convey("Should not be able to make moves", func() {
+			HandleMakeMove(watcher, json.RawMessage(`{"x":1}`), *gi)
+			So(emitted, ShouldResemble, []string{spectating, clientError})
+			So(events, ShouldBeEmpty)
+		})
+		Convey("Should be limited by the game", func() {
+			other := emittingComm{testComm: testComm{ID: "other"}, events: &emitted}
+			HandleSpectateRoom(other, SpectateRequest{RoomName: rn}, *gi)
+			So(emitted, ShouldResemble, []string{spectating, clientError})
+			So(len(room.Spectators()), ShouldEqual, 1)
+		})
+		Convey("Should be able to leave", func() {
+			HandleLeaveRoom(watcher, *gi)
+			So(emitted, ShouldResemble, []string{spectating, leftRoom})
+			So(room.Spectators(), ShouldBeEmpty)
+			_, watching := gi.SpectatorMap.Get(watcher.ID)
+			So(watching, ShouldBeFalse)
+		})
+		Convey("Should be removed when the room closes", func() {
+			CloseRoom(rn, "Game over", *gi)
+			_, watching := gi.SpectatorMap.Get(watcher.ID)
+			So(watching, ShouldBeFalse)
+		})
+	})
+}
+
+func TestReadyCheck(t *testing.T) {
+	Convey("Games with a ready check", t, func() {
+		g := domain.Game{
+			UUID:              "test-game",
+			MinPlayers:        2,
+			ReadyCheckSeconds: 60,
+			Lobby:             domain.NewLobby(),
+		}
+		games := domain.NewGameStore(domain.GameMap{g.UUID: g})
+		gi := newTestControl()
+		emitted := map[string]*[]string{}
+		players := []emittingComm{}
+		for _, id := range []string{"testID", "testID2", "testID3"} {
+			emitted[id] = &[]string{}
+			players = append(players, emittingComm{
+				testComm: testComm{ID: id},
+				events:   emitted[id],
+			})
+		}
+		HandlePlayerJoin(players[0], GameJoinRequest{GameID: g.UUID}, games, *gi)
+		HandlePlayerJoin(players[1], GameJoinRequest{GameID: g.UUID}, games, *gi)
+		HandlePlayerJoin(players[2], GameJoinRequest{GameID: g.UUID}, games, *gi)
+		m, found := gi.Matches.ByPlayer("testID")
+
+		Convey("Should ask the players of a group to be ready", func() {
+			So(found, ShouldBeTrue)
+			So(*emitted["testID"], ShouldResemble, []string{inQueue, matchFound})
+			So(g.Lobby.Size(), ShouldEqual, 1)
+		})
+		Convey("Should seat the group once everyone is ready", func() {
+			HandleReady(players[0], games, *gi)
+			_, inRoom := gi.RoomMap.Get("testID")
+			So(inRoom, ShouldBeFalse)
+			HandleReady(players[1], games, *gi)
+			_, inRoom = gi.RoomMap.Get("testID")
+			So(inRoom, ShouldBeTrue)
+			So(*emitted["testID2"], ShouldResemble,
+				[]string{inQueue, matchFound, groupAssignment})
+		})
+		Convey("Should cancel the match if its game was removed", func() {
+			HandleReady(players[0], games, *gi)
+			games.Del(g.UUID)
+			HandleReady(players[1], games, *gi)
+			_, inRoom := gi.RoomMap.Get("testID")
+			So(inRoom, ShouldBeFalse)
+			_, queued := gi.QueueMap.Get("testID")
+			So(queued, ShouldBeFalse)
+			So(*emitted["testID"], ShouldResemble,
+				[]string{inQueue, matchFound, matchCancelled})
+			So(*emitted["testID2"], ShouldResemble,
+				[]string{inQueue, matchFound, clientError, matchCancelled})
+		})
+		Convey("Should drop players who decline and requeue the others", func() {
+			HandleDecline(players[1], games, *gi)
+			_, queued := gi.QueueMap.Get("testID2")
+			So(queued, ShouldBeFalse)
+			So(*emitted["testID2"], ShouldResemble,
+				[]string{inQueue, matchFound, matchCancelled})
+			// testID is back at the front and matched again with testID3.
+			again, _ := gi.Matches.ByPlayer("testID")
+			So(again.ID, ShouldNotEqual, m.ID)
+			So(again.Players[0].Comm.Id(), ShouldEqual, "testID")
+			So(again.Players[1].Comm.Id(), ShouldEqual, "testID3")
+		})
+		Convey("Should drop players who are not ready in time", func() {
+			HandleReady(players[0], games, *gi)
+			ExpireMatch(m.ID, games, *gi)
+			_, queued := gi.QueueMap.Get("testID2")
+			So(queued, ShouldBeFalse)
+			_, queued = gi.QueueMap.Get("testID")
+			So(queued, ShouldBeTrue)
+			_, stillMatched := gi.Matches.ByPlayer("testID2")
+			So(stillMatched, ShouldBeFalse)
+		})
+	})
+}
+
+func TestTeams(t *testing.T) {
+	Convey("Teams", t, func() {
+		players := []domain.Player{}
+		for _, id := range []string{"a", "b", "c", "d"} {
+			players = append(players, domain.Player{Comm: testComm{ID: id}})
+		}
+
+		Convey("Should be dealt out in turn by default", func() {
+			teams := domain.Teams{Count: 2}
+			So(teams.Assign(players), ShouldResemble, []int{0, 1, 0, 1})
+		})
+		Convey("Should be even when random", func() {
+			teams := domain.Teams{Count: 2, Strategy: domain.TeamsRandom}
+			sizes := map[int]int{}
+			for _, team := range teams.Assign(players) {
+				sizes[team]++
+			}
+			So(sizes, ShouldResemble, map[int]int{0: 2, 1: 2})
+		})
+		Convey("Should keep parties together", func() {
+			players[1].Party = "p"
+			players[3].Party = "p"
+			teams := domain.Teams{Count: 2, Size: 2,
+				Strategy: domain.TeamsPartyPreserving}
+			assigned := teams.Assign(players)
+			So(assigned[1], ShouldEqual, assigned[3])
+			So(assigned[0], ShouldEqual, assigned[2])
+			So(assigned[0], ShouldNotEqual, assigned[1])
+		})
+		Convey("Should be told to players and scope team messages", func() {
+			g := domain.Game{
+				UUID:       "test-game",
+				MinPlayers: 4,
+				Teams:      domain.Teams{Count: 2},
+				Lobby:      domain.NewLobby(),
+			}
+			gi := newTestControl()
+			gi.MaxMessageLength = 500
+			received := map[string]*[]string{}
+			for i, id := range []string{"a", "b", "c", "d"} {
+				received[id] = &[]string{}
+				players[i].Comm = emittingComm{testComm: testComm{ID: id},
+					events: received[id]}
+				QueuePlayers(g, players[i])
+			}
+			rn, group := GroupPlayers(g, gi)
+			room, _ := gi.Rooms.Get(rn)
+			So(room.Team(2), ShouldEqual, 0)
+			AnnounceGroup(rn, group, *gi)
+			HandleTeamMessage(players[0].Comm.(emittingComm),
+				MessageRequest{Text: "hi"}, *gi)
+			So(*received["a"], ShouldResemble, []string{groupAssignment, teamMessage})
+			So(*received["c"], ShouldResemble, []string{groupAssignment, teamMessage})
+			So(*received["b"], ShouldResemble, []string{groupAssignment})
+		})
+	})
+}
+
+func TestParties(t *testing.T) {
+	Convey("Parties", t, func() {
+		g := domain.Game{
+			UUID:       "test-game",
+			MinPlayers: 2,
+			MaxPlayers: 3,
+			Lobby:      domain.NewLobby(),
+		}
+		games := domain.NewGameStore(domain.GameMap{g.UUID: g})
+		events := []string{}
+		gi := newTestControl()
+		gi.Broadcaster = testBroadcaster{events: &events}
+		emitted := map[string]*[]string{}
+		players := map[string]emittingComm{}
+		for _, id := range []string{"solo", "solo2", "leader", "friend"} {
+			emitted[id] = &[]string{}
+			players[id] = emittingComm{testComm: testComm{ID: id},
+				events: emitted[id]}
+		}
+		HandleCreateParty(players["leader"], *gi)
+		HandleInviteToParty(players["leader"],
+			PartyInviteRequest{PlayerID: "friend"}, *gi)
+		party, _ := gi.Parties.ByPlayer("leader")
+		HandleJoinParty(players["friend"], PartyJoinRequest{PartyID: party.ID}, *gi)
+
+		Convey("Should need an invite to be joined", func() {
+			So(events, ShouldResemble, []string{partyInvite})
+			HandleJoinParty(players["solo"], PartyJoinRequest{PartyID: party.ID}, *gi)
+			So(*emitted["solo"], ShouldResemble, []string{clientError})
+			party, _ = gi.Parties.ByPlayer("leader")
+			So(party.MemberIDs(), ShouldResemble, []string{"leader", "friend"})
+		})
+		Convey("Should only be queued by their leader", func() {
+			HandlePlayerJoin(players["friend"], GameJoinRequest{GameID: g.UUID},
+				games, *gi)
+			So(*emitted["friend"], ShouldResemble,
+				[]string{partyUpdate, clientError})
+			So(g.Lobby.Size(), ShouldEqual, 0)
+		})
+		Convey("Should be queued and grouped as a whole", func() {
+			HandlePlayerJoin(players["solo"], GameJoinRequest{GameID: g.UUID},
+				games, *gi)
+			HandlePlayerJoin(players["solo2"], GameJoinRequest{GameID: g.UUID},
+				games, *gi)
+			HandlePlayerJoin(players["leader"], GameJoinRequest{GameID: g.UUID},
+				games, *gi)
+			So(*emitted["friend"], ShouldResemble,
+				[]string{partyUpdate, inQueue, groupAssignment})
+			// The party only fits with one of the solo players, the oldest.
+			So(g.Lobby.Contains("solo2"), ShouldBeTrue)
+			room, _ := gi.RoomMap.Get("leader")
+			friendRoom, _ := gi.RoomMap.Get("friend")
+			soloRoom, _ := gi.RoomMap.Get("solo")
+			So(room, ShouldNotBeEmpty)
+			So(friendRoom, ShouldEqual, room)
+			So(soloRoom, ShouldEqual, room)
+		})
+		Convey("Should be refused by games whose teams can't hold them", func() {
+			teamGame := domain.Game{
+				UUID:       "team-game",
+				MinPlayers: 2,
+				MaxPlayers: 2,
+				Teams:      domain.Teams{Count: 2, Size: 1},
+				Lobby:      domain.NewLobby(),
+			}
+			games.Set(teamGame)
+			HandlePlayerJoin(players["leader"], GameJoinRequest{GameID: teamGame.UUID},
+				games, *gi)
+			So(*emitted["leader"], ShouldResemble,
+				[]string{partyUpdate, partyUpdate, clientError})
+			So(teamGame.Lobby.Size(), ShouldEqual, 0)
+		})
+		Convey("Should only be queued when every member is free", func() {
+			gi.SpectatorMap.Set("friend", "some-room")
+			HandlePlayerJoin(players["leader"], GameJoinRequest{GameID: g.UUID},
+				games, *gi)
+			So(*emitted["friend"], ShouldResemble, []string{partyUpdate, clientError})
+			So(*emitted["leader"], ShouldResemble,
+				[]string{partyUpdate, partyUpdate, clientError})
+			So(g.Lobby.Size(), ShouldEqual, 0)
+		})
+		Convey("Should never be split by the lobby", func() {
+			queueTestPlayers(g, "solo", "solo2")
+			g.Lobby.AddPartyToQueue([]domain.Player{
+				{Comm: testComm{ID: "a"}, Party: "p"},
+				{Comm: testComm{ID: "b"}, Party: "p"},
+			})
+			queueTestPlayers(g, "solo3")
+			group := g.Lobby.PopGroup(2, 3, 0)
+			ids := []string{}
+			for _, p := range group {
+				ids = append(ids, p.Comm.Id())
+			}
+			So(ids, ShouldResemble, []string{"solo", "solo2", "solo3"})
+			So(g.Lobby.Size(), ShouldEqual, 2)
+		})
+		Convey("Should be kept on one team", func() {
+			teams := domain.Teams{Count: 2}
+			assigned := teams.Assign([]domain.Player{
+				{Comm: testComm{ID: "a"}},
+				{Comm: testComm{ID: "b"}, Party: "p"},
+				{Comm: testComm{ID: "c"}, Party: "p"},
+				{Comm: testComm{ID: "d"}},
+			})
+			So(assigned[1], ShouldEqual, assigned[2])
+			So(assigned[0], ShouldEqual, assigned[3])
+		})
+		Convey("Should pass leadership on when the leader leaves", func() {
+			HandleLeaveParty(players["leader"], games, *gi)
+			party, _ = gi.Parties.ByPlayer("friend")
+			So(party.Leader, ShouldEqual, "friend")
+			_, inParty := gi.Parties.ByPlayer("leader")
+			So(inParty, ShouldBeFalse)
+		})
+	})
+}
+
+func TestRatings(t *testing.T) {
+	Convey("Ratings", t, func() {
+		Convey("Should move by half of K between equal players", func() {
+			updated := domain.Elo([]float64{1500, 1500}, []int{0, 1}, domain.EloK)
+			So(updated, ShouldResemble, []float64{1516, 1484})
+		})
+		Convey("Should group players with close ratings", func() {
+			g := domain.Game{
+				UUID:         "test-game",
+				MinPlayers:   2,
+				Matchmaking:  domain.MatchmakingRating,
+				RatingSpread: 50,
+				Lobby:        domain.NewLobby(),
+			}
+			games := domain.NewGameStore(domain.GameMap{g.UUID: g})
+			events := []string{}
+			gi := newTestControl()
+			gi.Broadcaster = testBroadcaster{events: &events}
+			emitted := []string{}
+			for i, rating := range []float64{1000, 2000, 1020} {
+				seed := rating
+				p := emittingComm{testComm: testComm{ID: string('a' + rune(i))},
+					events: &emitted}
+				HandlePlayerJoin(p, GameJoinRequest{GameID: g.UUID, Rating: &seed},
+					games, *gi)
+			}
+			So(g.Lobby.Contains("b"), ShouldBeTrue)
+			rn, _ := gi.RoomMap.Get("a")
+			other, _ := gi.RoomMap.Get("c")
+			So(rn, ShouldNotBeEmpty)
+			So(other, ShouldEqual, rn)
+
+			Convey("And update them once every player reported the result", func() {
+				reporter := emittingComm{testComm: testComm{ID: "c"}, events: &emitted}
+				other := emittingComm{testComm: testComm{ID: "a"}, events: &emitted}
+				HandleReportResult(reporter, ResultRequest{Ranks: []int{1, 0}}, *gi)
+				So(events, ShouldBeEmpty)
+				_, rated := gi.Ratings.Rating(g.UUID, "a")
+				So(rated, ShouldBeFalse)
+				HandleReportResult(other, ResultRequest{Ranks: []int{1, 0}}, *gi)
+				So(events, ShouldResemble, []string{ratingsUpdated})
+				a, _ := gi.Ratings.Rating(g.UUID, "a")
+				c, _ := gi.Ratings.Rating(g.UUID, "c")
+				So(a, ShouldBeLessThan, 1000)
+				So(c, ShouldBeGreaterThan, 1020)
+				emitted = emitted[:0]
+				HandleReportResult(reporter, ResultRequest{Ranks: []int{0, 1}}, *gi)
+				So(events, ShouldResemble, []string{ratingsUpdated})
+				So(emitted, ShouldResemble, []string{clientError})
+			})
+			Convey("And not update them while players dispute the result", func() {
+				reporter := emittingComm{testComm: testComm{ID: "c"}, events: &emitted}
+				other := emittingComm{testComm: testComm{ID: "a"}, events: &emitted}
+				HandleReportResult(reporter, ResultRequest{Ranks: []int{1, 0}}, *gi)
+				emitted = emitted[:0]
+				HandleReportResult(other, ResultRequest{Ranks: []int{0, 1}}, *gi)
+				So(emitted, ShouldResemble, []string{clientError})
+				So(events, ShouldBeEmpty)
+				_, rated := gi.Ratings.Rating(g.UUID, "a")
+				So(rated, ShouldBeFalse)
+			})
+		})
+		Convey("Should be applied to private rooms", func() {
+			g := domain.Game{
+				UUID:        "test-game",
+				MinPlayers:  2,
+				MaxPlayers:  2,
+				Matchmaking: domain.MatchmakingRating,
+				Lobby:       domain.NewLobby(),
+			}
+			games := domain.NewGameStore(domain.GameMap{g.UUID: g})
+			events := []string{}
+			gi := newTestControl()
+			gi.Broadcaster = testBroadcaster{events: &events}
+			gi.Ratings.SetRating(g.UUID, "host", 1800)
+			emitted := []string{}
+			host := emittingComm{testComm: testComm{ID: "host"}, events: &emitted}
+			guest := emittingComm{testComm: testComm{ID: "guest"}, events: &emitted}
+			HandleCreatePrivateRoom(host, GameJoinRequest{GameID: g.UUID}, games, *gi)
+			pr, _ := gi.PrivateRooms.ByPlayer("host")
+			HandleJoinPrivateRoom(guest, PrivateRoomRequest{Code: pr.Code}, games, *gi)
+			HandleReportResult(host, ResultRequest{Ranks: []int{1, 0}}, *gi)
+			HandleReportResult(guest, ResultRequest{Ranks: []int{1, 0}}, *gi)
+			rating, _ := gi.Ratings.Rating(g.UUID, "host")
+			So(rating, ShouldBeLessThan, 1800)
+			So(rating, ShouldBeGreaterThan, 1770)
+			rating, _ = gi.Ratings.Rating(g.UUID, "guest")
+			So(rating, ShouldBeGreaterThan, domain.DefaultRating)
+		})
+		Convey("Should be kept in a file", func() {
+			dir, _ := ioutil.TempDir("", "toto-ratings")
+			defer os.RemoveAll(dir)
+			file := filepath.Join(dir, "ratings.json")
+			store, err := domain.NewFileRatingStore(file)
+			So(err, ShouldBeNil)
+			So(store.SetRating("test-game", "a", 1234), ShouldBeNil)
+			reloaded, err := domain.NewFileRatingStore(file)
+			So(err, ShouldBeNil)
+			rating, exists := reloaded.Rating("test-game", "a")
+			So(exists, ShouldBeTrue)
+			So(rating, ShouldEqual, 1234.0)
+		})
+	})
+}
+
+func TestProfiles(t *testing.T) {
+	Convey("Player profiles", t, func() {
+		gi := newTestControl()
+		emitted := []string{}
+		so := emittingComm{testComm: testComm{ID: "testID"}, events: &emitted}
+		HandleIdentify(so, IdentifyRequest{DisplayName: "Ada"}, *gi)
+		id, hasProfile := gi.Identities.Get("testID")
+
+		Convey("Should be created when identifying without an id", func() {
+			So(hasProfile, ShouldBeTrue)
+			So(emitted, ShouldResemble, []string{identified})
+			So(NewPlayer(so, *gi).Profile.DisplayName, ShouldEqual, "Ada")
+		})
+		Convey("Should be loaded when identifying with an id", func() {
+			again := emittingComm{testComm: testComm{ID: "testID2"}, events: &emitted}
+			HandleIdentify(again, IdentifyRequest{ID: id}, *gi)
+			p := NewPlayer(again, *gi)
+			So(p.Profile.ID, ShouldEqual, id)
+			So(p.Profile.DisplayName, ShouldEqual, "Ada")
+		})
+		Convey("Should name the players of a room", func() {
+			g := domain.Game{
+				MinPlayers: 2,
+				Lobby:      domain.NewLobby(),
+			}
+			QueuePlayers(g, NewPlayer(so, *gi))
+			queueTestPlayers(g, "testID2")
+			rn, _ := GroupPlayers(g, gi)
+			room, _ := gi.Rooms.Get(rn)
+			So(room.DisplayName(0), ShouldEqual, "Ada")
+			So(room.DisplayName(1), ShouldBeEmpty)
+		})
+		Convey("Should be kept in a file", func() {
+			dir, _ := ioutil.TempDir("", "toto-players")
+			defer os.RemoveAll(dir)
+			file := filepath.Join(dir, "players.json")
+			store, err := domain.NewFilePlayerStore(file)
+			So(err, ShouldBeNil)
+			So(store.Store(domain.Player{Profile: domain.Profile{ID: id,
+				DisplayName: "Ada"}}), ShouldBeNil)
+			reloaded, err := domain.NewFilePlayerStore(file)
+			So(err, ShouldBeNil)
+			p, err := reloaded.Get(id)
+			So(err, ShouldBeNil)
+			So(p.Profile.DisplayName, ShouldEqual, "Ada")
+			_, err = reloaded.Get("nobody")
+			So(err, ShouldEqual, domain.ErrNoSuchPlayer)
+		})
+	})
+}
+
+// requestComm is a socket whose handshake was the given request
+type requestComm struct {
+	emittingComm
+	req *http.Request
+}
+
+func (r requestComm) Request() *http.Request {
+	return r.req
+}
+
+func TestAuth(t *testing.T) {
+	Convey("Tokens", t, func() {
+		secret := []byte("s3cret")
+		now := time.Now()
+		token, _ := utils.SignToken(utils.Claims{
+			Subject:   "user-1",
+			ExpiresAt: now.Add(time.Hour).Unix(),
+		}, secret)
+
+		Convey("Should be verified with the secret", func() {
+			c, err := utils.VerifyToken(token, secret, now)
+			So(err, ShouldBeNil)
+			So(c.Subject, ShouldEqual, "user-1")
+			_, err = utils.VerifyToken(token, []byte("other"), now)
+			So(err, ShouldEqual, utils.ErrBadSignature)
+			_, err = utils.VerifyToken(token, secret, now.Add(2*time.Hour))
+			So(err, ShouldEqual, utils.ErrTokenExpired)
+		})
+		Convey("Should not be accepted unsigned", func() {
+			// {"alg":"none"}.{"sub":"user-1"}.
+			_, err := utils.VerifyToken("eyJhbGciOiJub25lIn0.eyJzdWIiOiJ1c2VyLTEifQ.",
+				secret, now)
+			So(err, ShouldEqual, utils.ErrUnsupportedAlg)
+		})
+		Convey("Should identify the players of a socket", func() {
+			gi := newTestControl()
+			gi.Auth = &Authenticator{Secret: secret}
+			events := []string{}
+			gi.Broadcaster = testBroadcaster{events: &events}
+			emitted := []string{}
+			req, _ := http.NewRequest("GET", "/socket.io/?token="+token, nil)
+			so := requestComm{
+				emittingComm: emittingComm{testComm: testComm{ID: "testID"},
+					events: &emitted},
+				req: req,
+			}
+			So(AuthenticateSocket(so, *gi), ShouldBeTrue)
+			So(NewPlayer(so, *gi).UserID, ShouldEqual, "user-1")
+			gi.RoomMap.Set("testID", "some-room")
+			gi.MaxMessageLength = 500
+			_, msg, ok := chatMessage(so, MessageRequest{Text: "hi"}, *gi)
+			So(ok, ShouldBeTrue)
+			So(msg["sentById"], ShouldEqual, "user-1")
+
+			noToken, _ := http.NewRequest("GET", "/socket.io/", nil)
+			anonymous := requestComm{
+				emittingComm: emittingComm{testComm: testComm{ID: "testID2"},
+					events: &emitted},
+				req: noToken,
+			}
+			So(AuthenticateSocket(anonymous, *gi), ShouldBeFalse)
+			So(emitted, ShouldResemble, []string{clientError})
+			So(gi.Auth.AllowRequest(anonymous.req), ShouldEqual, ErrNoToken)
+		})
+	})
+}
+
+func TestCORS(t *testing.T) {
+	Convey("Cross origin requests", t, func() {
+		origins, err := ParseOrigins("https://example.com, https://*.games.example.com")
+		So(err, ShouldBeNil)
+		s := corsServer{
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}),
+			Origins: origins,
+		}
+		request := func(method, origin string) *httptest.ResponseRecorder {
+			r, _ := http.NewRequest(method, "http://toto.example.com/socket.io/", nil)
+			r.Header.Set("Origin", origin)
+			if method == "OPTIONS" {
+				r.Header.Set("Access-Control-Request-Method", "POST")
+			}
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, r)
+			return w
+		}
+
+		Convey("Should be allowed from listed origins", func() {
+			w := request("GET", "https://example.com")
+			So(w.Code, ShouldEqual, http.StatusOK)
+			So(w.Header().Get("Access-Control-Allow-Origin"), ShouldEqual,
+				"https://example.com")
+			So(request("GET", "https://a.b.games.example.com").Code, ShouldEqual,
+				http.StatusOK)
+		})
+		Convey("Should be refused from other origins", func() {
+			So(request("GET", "https://games.example.com").Code, ShouldEqual,
+				http.StatusForbidden)
+			So(request("GET", "http://example.com").Code, ShouldEqual,
+				http.StatusForbidden)
+			So(request("GET", "https://evilexample.com").Code, ShouldEqual,
+				http.StatusForbidden)
+		})
+		Convey("Should answer preflight requests", func() {
+			w := request("OPTIONS", "https://example.com")
+			So(w.Code, ShouldEqual, http.StatusNoContent)
+			So(w.Header().Get("Access-Control-Allow-Methods"), ShouldContainSubstring,
+				"POST")
+		})
+		Convey("Should allow every origin in dev mode", func() {
+			s.AllowAll = true
+			So(request("GET", "https://anywhere.test").Code, ShouldEqual,
+				http.StatusOK)
+		})
+		Convey("Should reject invalid origins", func() {
+			_, err := ParseOrigins("https://example.com/path")
+			So(err, ShouldNotBeNil)
+			_, err = ParseOrigins("https://ex*mple.com")
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestTLS(t *testing.T) {
+	Convey("TLS", t, func() {
+		Convey("Should reload the certificate from its files", func() {
+			dir, _ := ioutil.TempDir("", "toto-tls")
+			defer os.RemoveAll(dir)
+			certFile := filepath.Join(dir, "cert.pem")
+			keyFile := filepath.Join(dir, "key.pem")
+			write := func() {
+				certPEM, keyPEM, err := utils.SelfSignedCert([]string{"localhost"},
+					time.Hour)
+				So(err, ShouldBeNil)
+				ioutil.WriteFile(certFile, certPEM, 0600)
+				ioutil.WriteFile(keyFile, keyPEM, 0600)
+			}
+			write()
+			cr, err := newCertReloader(certFile, keyFile)
+			So(err, ShouldBeNil)
+			first, _ := cr.GetCertificate(nil)
+			write()
+			So(cr.Reload(), ShouldBeNil)
+			second, _ := cr.GetCertificate(nil)
+			So(second.Certificate[0], ShouldNotResemble, first.Certificate[0])
+
+			// A broken file keeps the certificate that was loaded.
+			ioutil.WriteFile(certFile, []byte("nope"), 0600)
+			So(cr.Reload(), ShouldNotBeNil)
+			kept, _ := cr.GetCertificate(nil)
+			So(kept, ShouldEqual, second)
+		})
+		Convey("Should redirect plain HTTP to HTTPS", func() {
+			r, _ := http.NewRequest("GET", "http://example.com:8080/socket.io/?EIO=3", nil)
+			w := httptest.NewRecorder()
+			RedirectToHTTPS("8443").ServeHTTP(w, r)
+			So(w.Code, ShouldEqual, http.StatusMovedPermanently)
+			So(w.Header().Get("Location"), ShouldEqual,
+				"https://example.com:8443/socket.io/?EIO=3")
+		})
+	})
+}
+
+func TestConfig(t *testing.T) {
+	Convey("Config", t, func() {
+		dir, _ := ioutil.TempDir("", "toto-config")
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "toto.toml")
+		ioutil.WriteFile(path, []byte(`
+listen = "127.0.0.1:4000"
+colour = "blue"
+[log]
+level = "info"
+[cors]
+origins = ["https://example.com"]
+[timeouts]
+reconnectGrace = "1m"
+[features]
+adminToken = "secret"
+`), 0644)
+		// load runs a small app with some of the server's flags, the way main
+		// does, and returns the config it loaded.
+		load := func(args ...string) (Config, error) {
+			var cfg Config
+			var err error
+			app := cli.NewApp()
+			app.Flags = []cli.Flag{
+				cli.StringFlag{Name: "config", Value: defaultConfigFile},
+				cli.StringFlag{Name: "listen", EnvVar: "TOTO_TEST_LISTEN"},
+				cli.StringFlag{Name: "port, p"},
+				cli.StringFlag{Name: "log-level"},
+				cli.DurationFlag{Name: "reconnect-grace"},
+				cli.StringFlag{Name: "admin-token"},
+			}
+			app.Action = func(c *cli.Context) {
+				cfg, err = LoadConfig(c)
+			}
+			app.Run(append([]string{"toto", "--config", path}, args...))
+			return cfg, err
+		}
+		Convey("Should read the file over the defaults", func() {
+			cfg := DefaultConfig()
+			unknown, err := ReadConfigFile(path, &cfg)
+			So(err, ShouldBeNil)
+			So(unknown, ShouldResemble, []string{"colour"})
+			So(cfg.Listen, ShouldEqual, "127.0.0.1:4000")
+			So(cfg.Log.Level, ShouldEqual, "info")
+			So(cfg.Log.Format, ShouldEqual, "text")
+			So(cfg.Timeouts.ReconnectGrace.Duration, ShouldEqual, time.Minute)
+			So(cfg.Timeouts.ReloadInterval.Duration, ShouldEqual, 2*time.Second)
+			So(cfg.GamesDir, ShouldEqual, "./games")
+		})
+		Convey("Should let environment variables and flags override the file", func() {
+			cfg, err := load()
+			So(err, ShouldBeNil)
+			So(cfg.Listen, ShouldEqual, "127.0.0.1:4000")
+			So(cfg.CORS.Origins, ShouldResemble, []string{"https://example.com"})
+
+			os.Setenv("TOTO_TEST_LISTEN", ":5000")
+			defer os.Unsetenv("TOTO_TEST_LISTEN")
+			cfg, err = load("--log-level", "warn", "--reconnect-grace", "5s")
+			So(err, ShouldBeNil)
+			So(cfg.Listen, ShouldEqual, ":5000")
+			So(cfg.Log.Level, ShouldEqual, "warn")
+			So(cfg.Timeouts.ReconnectGrace.Duration, ShouldEqual, 5*time.Second)
+
+			cfg, err = load("-p", "6000")
+			So(err, ShouldBeNil)
+			So(cfg.Listen, ShouldEqual, ":6000")
+			So(cfg.Port(), ShouldEqual, "6000")
+		})
+		Convey("Should reject invalid values", func() {
+			_, err := load("--log-level", "loud")
+			So(err, ShouldNotBeNil)
+			_, err = load("--listen", "nowhere")
+			So(err, ShouldNotBeNil)
+			cfg := DefaultConfig()
+			cfg.TLS.RedirectPort = "8080"
+			So(cfg.Validate(), ShouldNotBeNil)
+			cfg.TLS.SelfSigned = true
+			So(cfg.Validate(), ShouldBeNil)
+			ioutil.WriteFile(path, []byte(`[cors]
+origins = ["example.com"]`), 0644)
+			_, err = load()
+			So(err, ShouldNotBeNil)
+		})
+		Convey("Should only require the file when it is given", func() {
+			path = filepath.Join(dir, "missing.toml")
+			_, err := load()
+			So(err, ShouldNotBeNil)
+		})
+		Convey("Should redact secrets", func() {
+			cfg, _ := load()
+			So(cfg.Redacted().Features.AdminToken, ShouldEqual, "[redacted]")
+			So(cfg.Features.AdminToken, ShouldEqual, "secret")
+			So(DefaultConfig().Redacted().Features.AdminToken, ShouldEqual, "")
+		})
+	})
+}
+
+func TestShutdown(t *testing.T) {
+	Convey("Shutting down", t, func() {
+		g := domain.Game{
+			UUID:       "test-game",
+			MinPlayers: 2,
+			MaxPlayers: 2,
+			Lobby:      domain.NewLobby(),
+		}
+		games := domain.NewGameStore(domain.GameMap{g.UUID: g})
+		events := []string{}
+		gi := newTestControl()
+		gi.Broadcaster = testBroadcaster{events: &events}
+		queueTestPlayers(g, "testID", "testID2")
+		rn, _ := GroupPlayers(g, gi)
+		HandlePlayerJoin(testComm{ID: "testID3"}, GameJoinRequest{GameID: g.UUID},
+			games, *gi)
+
+		Convey("Should tell rooms and queued players and stop new joins", func() {
+			DrainServer(games, *gi, 50*time.Millisecond, 10*time.Millisecond)
+			So(events, ShouldResemble, []string{serverShutdown, serverShutdown, roomClosed})
+			So(g.Lobby.Size(), ShouldEqual, 0)
+			_, queued := gi.QueueMap.Get("testID3")
+			So(queued, ShouldBeFalse)
+
+			emitted := []string{}
+			p := emittingComm{testComm: testComm{ID: "testID4"}, events: &emitted}
+			HandlePlayerJoin(p, GameJoinRequest{GameID: g.UUID}, games, *gi)
+			So(emitted, ShouldResemble, []string{clientError})
+			So(g.Lobby.Size(), ShouldEqual, 0)
+		})
+		Convey("Should tell and remove the players waiting in private rooms", func() {
+			emitted := []string{}
+			host := emittingComm{testComm: testComm{ID: "host"}, events: &emitted}
+			HandleCreatePrivateRoom(host, GameJoinRequest{GameID: g.UUID}, games, *gi)
+			DrainServer(games, *gi, 0, 10*time.Millisecond)
+			So(emitted, ShouldResemble, []string{privateRoomUpdate, serverShutdown})
+			_, waiting := gi.PrivateRooms.ByPlayer("host")
+			So(waiting, ShouldBeFalse)
+			So(gi.PrivateRooms.All(), ShouldBeEmpty)
+		})
+		Convey("Should close the rooms left at the deadline", func() {
+			DrainServer(games, *gi, 0, 10*time.Millisecond)
+			_, exists := gi.Rooms.Get(rn)
+			So(exists, ShouldBeFalse)
+			_, inRoom := gi.RoomMap.Get("testID")
+			So(inRoom, ShouldBeFalse)
+		})
+		Convey("Should stop waiting once every room has finished", func() {
+			time.AfterFunc(20*time.Millisecond, func() {
+				CloseRoom(rn, "Game over", *gi)
+			})
+			start := time.Now()
+			DrainServer(games, *gi, time.Minute, 10*time.Millisecond)
+			So(time.Since(start), ShouldBeLessThan, time.Second)
+			So(gi.Drainer.Deadline().After(start), ShouldBeTrue)
+		})
+	})
+}
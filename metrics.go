@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/tiltfactor/toto/domain"
+	"github.com/tiltfactor/toto/utils"
+)
+
+// metrics are always recorded but are only served when the metrics flag is on
+var metrics = struct {
+	Sockets      *utils.Gauge
+	RoomsCreated *utils.Counter
+	Moves        *utils.Counter
+	Errors       *utils.Counter
+	QueueWait    *utils.Histogram
+}{
+	Sockets: utils.NewGauge("toto_connected_sockets",
+		"Number of connected sockets."),
+	RoomsCreated: utils.NewCounter("toto_rooms_created_total",
+		"Number of rooms created.", "game"),
+	Moves: utils.NewCounter("toto_moves_total",
+		"Number of moves relayed to rooms.", "game"),
+	Errors: utils.NewCounter("toto_errors_total",
+		"Number of errors sent to clients.", "kind", "message"),
+	QueueWait: utils.NewHistogram("toto_queue_wait_seconds",
+		"Time players spent in a lobby before being placed in a room.",
+		utils.DefaultBuckets, "game"),
+}
+
+// MetricsHandler serves the metrics in the Prometheus text format along with
+// the length of each game's queue and the number of rooms it has running.
+func MetricsHandler(games *domain.GameStore, info Control) http.Handler {
+	queues := utils.NewGaugeFunc("toto_queue_length",
+		"Number of players waiting in each game's lobby.", []string{"game"},
+		func(set func(float64, ...string)) {
+			for _, g := range games.All() {
+				set(float64(g.Lobby.Size()), g.UUID)
+			}
+		})
+	rooms := utils.NewGaugeFunc("toto_rooms_active",
+		"Number of rooms running for each game.", []string{"game"},
+		func(set func(float64, ...string)) {
+			for _, g := range games.All() {
+				set(float64(info.Rooms.CountGame(g.UUID)), g.UUID)
+			}
+		})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		err := utils.WriteMetrics(w, metrics.Sockets, queues, metrics.RoomsCreated,
+			rooms, metrics.Moves, metrics.Errors, metrics.QueueWait)
+		if err != nil {
+			log.Error("Unable to write metrics: ", err)
+		}
+	})
+}
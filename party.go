@@ -0,0 +1,180 @@
+package main
+
+import (
+	"github.com/googollee/go-socket.io"
+	"github.com/jesusrmoreno/sad-squid"
+	"github.com/tiltfactor/toto/domain"
+)
+
+// HandleCreateParty is called when a player wants to queue with friends. The
+// player becomes the leader of a new party that others can join once invited.
+func HandleCreateParty(so socketio.Socket, info Control) {
+	party, err := info.Parties.Create(squid.GenerateSimpleID(),
+		NewPlayer(so, info))
+	if err != nil {
+		so.Emit(clientError, ErrorResponse(clientError, err.Error()))
+		return
+	}
+	log.Debug(so.Id(), "created party", party.ID)
+	EmitPartyUpdate(party)
+}
+
+// HandleInviteToParty is called when the leader of a party invites another
+// player to it. The invited player is sent party-invite with the party's id.
+func HandleInviteToParty(so socketio.Socket, r PartyInviteRequest,
+	info Control) {
+	if r.PlayerID == "" {
+		so.Emit(clientError, ErrorResponse(clientError, "Must include playerId"))
+		return
+	}
+	if r.PlayerID == so.Id() {
+		so.Emit(clientError, ErrorResponse(clientError, "Cannot invite yourself"))
+		return
+	}
+	party, err := info.Parties.Invite(so.Id(), r.PlayerID)
+	if err != nil {
+		so.Emit(clientError, ErrorResponse(clientError, err.Error()))
+		return
+	}
+	log.Debug(so.Id(), "invited", r.PlayerID, "to party", party.ID)
+	data := map[string]interface{}{}
+	data["partyId"] = party.ID
+	data["from"] = so.Id()
+	data["members"] = len(party.Members)
+	// Every socket is in a room named after its id.
+	info.Broadcaster.BroadcastTo(r.PlayerID, partyInvite,
+		WrapResponse(partyInvite, data))
+}
+
+// HandleJoinParty is called when a player accepts an invite to a party. A
+// party can't be joined while it is queued.
+func HandleJoinParty(so socketio.Socket, r PartyJoinRequest, info Control) {
+	if r.PartyID == "" {
+		so.Emit(clientError, ErrorResponse(clientError, "Must include partyId"))
+		return
+	}
+	if _, queued := info.QueueMap.Get(so.Id()); queued {
+		so.Emit(clientError, ErrorResponse(clientError, "Already in queue"))
+		return
+	}
+	if party, exists := info.Parties.ByID(r.PartyID); exists {
+		if _, queued := info.QueueMap.Get(party.Leader); queued {
+			so.Emit(clientError, ErrorResponse(clientError, "The party is in a queue"))
+			return
+		}
+	}
+	party, err := info.Parties.Join(r.PartyID, NewPlayer(so, info))
+	if err != nil {
+		so.Emit(clientError, ErrorResponse(clientError, err.Error()))
+		return
+	}
+	log.Debug(so.Id(), "joined party", party.ID)
+	EmitPartyUpdate(party)
+}
+
+// HandleLeaveParty is called when a player leaves their party. If the party
+// is queued the player leaves the queue along with it while the rest of the
+// party stays queued.
+func HandleLeaveParty(so socketio.Socket, games *domain.GameStore,
+	info Control) {
+	if _, inParty := info.Parties.ByPlayer(so.Id()); !inParty {
+		so.Emit(clientError, ErrorResponse(clientError, "Not in a party"))
+		return
+	}
+	if gameID, ok := DequeuePlayer(so.Id(), games, info); ok {
+		data := map[string]interface{}{}
+		data["gameId"] = gameID
+		so.Emit(leftQueue, WrapResponse(leftQueue, data))
+	}
+	LeaveParty(so.Id(), info)
+	data := map[string]interface{}{}
+	data["partyId"] = ""
+	data["leader"] = ""
+	data["members"] = []string{}
+	so.Emit(partyUpdate, WrapResponse(partyUpdate, data))
+}
+
+// LeaveParty removes the player from their party and tells the members that
+// are left. It returns true if the player was in a party.
+func LeaveParty(id string, info Control) bool {
+	party, ok := info.Parties.Remove(id)
+	if ok && len(party.Members) > 0 {
+		log.Debug(id, "left party", party.ID)
+		EmitPartyUpdate(party)
+	}
+	return ok
+}
+
+// QueueParty adds every member of the leader's party to the game's lobby as a
+// single entry, so that they are placed in the same room and on the same team
+// when the game has teams. Each member is sent in-queue.
+func QueueParty(so socketio.Socket, r GameJoinRequest, party domain.Party,
+	g domain.Game, games *domain.GameStore, info Control) {
+	if party.Leader != so.Id() {
+		so.Emit(clientError, ErrorResponse(clientError,
+			"Only the party leader can join a game"))
+		return
+	}
+	max := g.MaxPlayers
+	if max == 0 {
+		max = g.MinPlayers
+	}
+	if len(party.Members) > max {
+		so.Emit(clientError, ErrorResponse(clientError,
+			"The party is too large for this game"))
+		return
+	}
+	// Parties are never split across teams.
+	if g.Teams.Enabled() && len(party.Members) > g.Teams.Capacity(max) {
+		so.Emit(clientError, ErrorResponse(clientError,
+			"The party is too large for a team of this game"))
+		return
+	}
+	// Members who aren't free are told why.
+	for _, m := range party.Members {
+		if !canEnterRoom(m.Comm, info) {
+			so.Emit(clientError, ErrorResponse(clientError,
+				"Every party member must be free to join a game"))
+			return
+		}
+	}
+	players := make([]domain.Player, len(party.Members))
+	for i, m := range party.Members {
+		m.Party = party.ID
+		// Only the leader's own rating can be seeded by their request.
+		var seed *float64
+		if m.Comm.Id() == party.Leader {
+			seed = r.Rating
+		}
+		players[i] = RatePlayer(g, m, seed, info)
+		// The game is recorded before queueing so that a group formed right
+		// away clears it.
+		info.QueueMap.Set(m.Comm.Id(), g.UUID)
+	}
+	g.Lobby.AddPartyToQueue(players)
+	log.Debug("Party", party.ID, "queued for game", g.UUID)
+	resp := WrapResponse(inQueue, struct {
+		Msg            string `json:"message"`
+		PlayersInQueue int    `json:"playersInQueue"`
+	}{
+		Msg:            "Your party is in the queue for game: " + g.Title,
+		PlayersInQueue: g.Lobby.Size(),
+	})
+	for _, p := range players {
+		p.Comm.Emit(inQueue, resp)
+	}
+	MatchPlayers(g, games, info)
+}
+
+// EmitPartyUpdate tells every member of the party who is in it and who leads
+// it.
+func EmitPartyUpdate(party domain.Party) {
+	data := map[string]interface{}{}
+	data["partyId"] = party.ID
+	data["leader"] = party.Leader
+	data["members"] = party.MemberIDs()
+	r := WrapResponse(partyUpdate, data)
+	for _, m := range party.Members {
+		m.Comm.Emit(partyUpdate, r)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"unicode/utf8"
+
+	"github.com/googollee/go-socket.io"
+	"github.com/tiltfactor/toto/domain"
+	"github.com/tiltfactor/toto/utils"
+)
+
+// The maximum number of characters in a display name
+const maxDisplayNameLength = 32
+
+// IdentifyRequest is the request that the client should send to tell the
+// server who the player is. Without an id a new profile is created, with one
+// the stored profile is loaded. The display name and metadata replace the
+// profile's when they are given.
+type IdentifyRequest struct {
+	ID          string                 `json:"id"`
+	DisplayName string                 `json:"displayName"`
+	Metadata    map[string]interface{} `json:"metadata"`
+}
+
+// HandleIdentify is called when a socket tells the server which player it is.
+// The profile is stored and sent back in identified, its id is what the
+// client should identify with the next time it connects. When auth is on the
+// profile's id is always the user id. Players that are already queued or
+// seated keep the profile they had.
+func HandleIdentify(so socketio.Socket, r IdentifyRequest, info Control) {
+	if utf8.RuneCountInString(r.DisplayName) > maxDisplayNameLength {
+		so.Emit(clientError, ErrorResponse(clientError, "Display name is too long"))
+		return
+	}
+	// Authenticated players always have the profile of their user.
+	if userID, ok := info.Users.Get(so.Id()); ok {
+		if r.ID != "" && r.ID != userID {
+			so.Emit(clientError, ErrorResponse(clientError,
+				"Cannot identify as another user"))
+			return
+		}
+		r.ID = userID
+	}
+	profile := domain.Profile{ID: r.ID}
+	if r.ID == "" {
+		profile.ID = utils.RandomToken(16)
+	} else if p, err := info.Players.Get(r.ID); err == nil {
+		profile = p.Profile
+	}
+	if r.DisplayName != "" {
+		profile.DisplayName = r.DisplayName
+	}
+	if r.Metadata != nil {
+		profile.Metadata = r.Metadata
+	}
+	if err := info.Players.Store(domain.Player{Profile: profile}); err != nil {
+		log.Error("Unable to store the profile of ", profile.ID, ": ", err)
+		so.Emit(serverError, ErrorResponse(serverError, "Unable to store profile"))
+		return
+	}
+	info.Identities.Set(so.Id(), profile.ID)
+	log.Debug(so.Id(), "identified as", profile.ID)
+	so.Emit(identified, WrapResponse(identified, profile))
+}
+
+// NewPlayer returns the player for the socket along with the profile it
+// identified with, if any.
+func NewPlayer(so socketio.Socket, info Control) domain.Player {
+	p := domain.Player{Comm: so}
+	p.UserID, _ = info.Users.Get(so.Id())
+	if id, exists := info.Identities.Get(so.Id()); exists {
+		if stored, err := info.Players.Get(id); err == nil {
+			p.Profile = stored.Profile
+		}
+	}
+	return p
+}
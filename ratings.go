@@ -0,0 +1,88 @@
+package main
+
+import (
+	"github.com/googollee/go-socket.io"
+	"github.com/tiltfactor/toto/domain"
+)
+
+// RatePlayer gives the player their rating for the game if it groups players
+// by rating. A stored rating always wins, the seed is only used for players
+// who have none yet and DefaultRating for those who didn't send one either.
+func RatePlayer(g domain.Game, p domain.Player, seed *float64,
+	info Control) domain.Player {
+	if !g.Rated() {
+		return p
+	}
+	if rating, exists := info.Ratings.Rating(g.UUID, ratingID(p)); exists {
+		p.Rating = rating
+	} else if seed != nil {
+		p.Rating = *seed
+	} else {
+		p.Rating = domain.DefaultRating
+	}
+	return p
+}
+
+// ratingID returns the id the player's ratings are stored under, their user
+// or profile id when they have one so that it is kept across connections.
+func ratingID(p domain.Player) string {
+	if p.UserID != "" {
+		return p.UserID
+	}
+	if p.Profile.ID != "" {
+		return p.Profile.ID
+	}
+	return p.Comm.Id()
+}
+
+// HandleReportResult is called when a player reports the result of their
+// rated room. Since any player could claim to have won, a result is only
+// applied once every player still seated has reported the same ranks. It then
+// updates the Elo rating of every player who was seated in the room, and the
+// room is sent ratings-updated with the new ratings and how much they changed,
+// both indexed by turn number.
+func HandleReportResult(so socketio.Socket, r ResultRequest, info Control) {
+	rn, exists := info.RoomMap.Get(so.Id())
+	if !exists {
+		so.Emit(clientError, ErrorResponse(clientError, "Not in any Room"))
+		return
+	}
+	room, exists := info.Rooms.Get(rn)
+	if !exists || !room.Rated {
+		so.Emit(clientError, ErrorResponse(clientError, "This game is not rated"))
+		return
+	}
+	if len(r.Ranks) != len(room.Seats()) {
+		so.Emit(clientError, ErrorResponse(clientError,
+			"Must include a rank for every turn"))
+		return
+	}
+	turn, _ := info.TurnMap.Get(TurnKey(so.Id(), rn))
+	players, agreed, err := room.ReportResult(turn, r.Ranks)
+	if err != nil {
+		so.Emit(clientError, ErrorResponse(clientError, err.Error()))
+		return
+	}
+	log.Debug(so.Id(), "reported the result of", rn)
+	if !agreed {
+		return
+	}
+	ratings := make([]float64, len(players))
+	for i, p := range players {
+		ratings[i] = p.Rating
+	}
+	updated := domain.Elo(ratings, r.Ranks, domain.EloK)
+	changes := make([]float64, len(players))
+	for i, p := range players {
+		changes[i] = updated[i] - ratings[i]
+		if err := info.Ratings.SetRating(room.GameID, ratingID(p),
+			updated[i]); err != nil {
+			log.Error("Unable to store the rating of ", ratingID(p), ": ", err)
+		}
+	}
+	data := map[string]interface{}{}
+	data["ratings"] = updated
+	data["changes"] = changes
+	info.Broadcaster.BroadcastTo(rn, ratingsUpdated,
+		WrapResponse(ratingsUpdated, data))
+}
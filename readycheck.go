@@ -0,0 +1,138 @@
+package main
+
+import (
+	"time"
+
+	"github.com/googollee/go-socket.io"
+	"github.com/jesusrmoreno/sad-squid"
+	"github.com/tiltfactor/toto/domain"
+	"github.com/tiltfactor/toto/utils"
+)
+
+// ProposeMatch holds the group popped from the game's lobby until every one of
+// its players is ready. Each player is sent match-found and has until the
+// deadline to reply with ready, after which the match is cancelled.
+func ProposeMatch(g domain.Game, group []domain.Player,
+	games *domain.GameStore, info Control) {
+	m := domain.Match{
+		ID:       utils.RandomToken(8),
+		GameID:   g.UUID,
+		Players:  group,
+		Deadline: time.Now().Add(g.ReadyCheck()),
+	}
+	info.Matches.Add(m)
+	log.Debug("Proposing match", m.ID, "for game", g.UUID)
+	data := map[string]interface{}{}
+	data["matchId"] = m.ID
+	data["gameId"] = g.UUID
+	data["players"] = len(group)
+	data["deadline"] = m.Deadline.UnixNano()
+	data["timeoutSeconds"] = g.ReadyCheckSeconds
+	r := WrapResponse(matchFound, data)
+	for _, p := range group {
+		p.Comm.Emit(matchFound, r)
+	}
+	time.AfterFunc(g.ReadyCheck(), func() {
+		ExpireMatch(m.ID, games, info)
+	})
+}
+
+// HandleReady is called when a player accepts the match they were found for.
+// Once every player of the match is ready they are seated in a new room and
+// sent group-assignment.
+func HandleReady(so socketio.Socket, games *domain.GameStore, info Control) {
+	m, allReady, ok := info.Matches.SetReady(so.Id())
+	if !ok {
+		so.Emit(clientError, ErrorResponse(clientError, "No match to accept"))
+		return
+	}
+	log.Debug(so.Id(), "is ready for match", m.ID)
+	if !allReady {
+		return
+	}
+	// The match may have expired or been cancelled in the meantime.
+	if m, ok = info.Matches.Take(m.ID); !ok {
+		return
+	}
+	// A reload may have removed the game while the players were replying.
+	g, exists := games.Get(m.GameID)
+	if !exists {
+		so.Emit(clientError, ErrorResponse(clientError, "Game is no longer available"))
+		breakUpMatch(m, nil, "Game is no longer available", games, info)
+		return
+	}
+	rn := squid.GenerateSimpleID()
+	SeatPlayers(rn, g, m.Players, &info)
+	observeQueueWait(g, m.Players)
+	AnnounceGroup(rn, m.Players, info)
+}
+
+// HandleDecline is called when a player turns down the match they were found
+// for. They leave the queue and the match is cancelled.
+func HandleDecline(so socketio.Socket, games *domain.GameStore, info Control) {
+	m, ok := info.Matches.ByPlayer(so.Id())
+	if !ok {
+		so.Emit(clientError, ErrorResponse(clientError, "No match to decline"))
+		return
+	}
+	CancelMatch(m.ID, []string{so.Id()}, "A player declined", games, info)
+}
+
+// CancelMatch cancels the match with the given id. The dropped players leave
+// the queue while the others are put back at the front of the game's lobby.
+// It does nothing if the match was seated or cancelled already.
+func CancelMatch(matchID string, dropped []string, reason string,
+	games *domain.GameStore, info Control) {
+	if m, ok := info.Matches.Take(matchID); ok {
+		breakUpMatch(m, dropped, reason, games, info)
+	}
+}
+
+// ExpireMatch cancels the match once its deadline has passed, dropping the
+// players that were not ready. It does nothing if the match was seated or
+// cancelled already.
+func ExpireMatch(matchID string, games *domain.GameStore, info Control) {
+	m, ok := info.Matches.Take(matchID)
+	if !ok {
+		return
+	}
+	dropped := []string{}
+	for _, p := range m.Players {
+		if !m.Ready[p.Comm.Id()] {
+			dropped = append(dropped, p.Comm.Id())
+		}
+	}
+	breakUpMatch(m, dropped, "Not every player was ready", games, info)
+}
+
+// breakUpMatch tells every player of the taken match that it was cancelled
+// and whether they are back in the queue. If the game can no longer be played,
+// or the server is shutting down, nobody is.
+func breakUpMatch(m domain.Match, dropped []string, reason string,
+	games *domain.GameStore, info Control) {
+	log.Debug("Cancelling match", m.ID, "because of", reason)
+	isDropped := map[string]bool{}
+	for _, id := range dropped {
+		isDropped[id] = true
+	}
+	g, playable := games.Playable(m.GameID)
+	requeue := []domain.Player{}
+	for _, p := range m.Players {
+		id := p.Comm.Id()
+		data := map[string]interface{}{}
+		data["matchId"] = m.ID
+		data["reason"] = reason
+		if isDropped[id] || !playable || info.Drainer.Draining() {
+			info.QueueMap.Del(id)
+			data["requeued"] = false
+		} else {
+			requeue = append(requeue, p)
+			data["requeued"] = true
+		}
+		p.Comm.Emit(matchCancelled, WrapResponse(matchCancelled, data))
+	}
+	if len(requeue) > 0 {
+		g.Lobby.Requeue(requeue)
+		MatchPlayers(g, games, info)
+	}
+}
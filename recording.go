@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/codegangsta/cli"
+	"github.com/googollee/go-socket.io"
+	"github.com/tiltfactor/toto/domain"
+)
+
+// RecordedEvent is a line of a room recording. To is the turn number of the
+// player the response was sent to and is left out for responses sent to the
+// whole room.
+type RecordedEvent struct {
+	Room     string   `json:"room"`
+	Event    string   `json:"event"`
+	To       *int     `json:"to,omitempty"`
+	Response Response `json:"response"`
+}
+
+// Recorder appends the responses sent to each room to a JSONL file named
+// after the room in its directory. Only rooms that were opened are recorded.
+// A nil Recorder records nothing so that recording can be left off.
+type Recorder struct {
+	Dir     string
+	protect *sync.Mutex
+	files   map[string]*os.File
+}
+
+// NewRecorder instantiates a new recorder that writes to the directory,
+// creating it if needed.
+func NewRecorder(dir string) (*Recorder, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &Recorder{
+		Dir:     dir,
+		protect: &sync.Mutex{},
+		files:   make(map[string]*os.File),
+	}, nil
+}
+
+// Open starts recording the room
+func (rec *Recorder) Open(rn string) {
+	if rec == nil {
+		return
+	}
+	rec.protect.Lock()
+	defer rec.protect.Unlock()
+	if _, exists := rec.files[rn]; exists {
+		return
+	}
+	f, err := os.Create(filepath.Join(rec.Dir, rn+".jsonl"))
+	if err != nil {
+		log.Error("Unable to record ", rn, ": ", err)
+		return
+	}
+	rec.files[rn] = f
+}
+
+// Record appends the response to the room's recording if it is being
+// recorded. to is nil for responses sent to the whole room.
+func (rec *Recorder) Record(rn, event string, to *int, r Response) {
+	if rec == nil {
+		return
+	}
+	rec.protect.Lock()
+	defer rec.protect.Unlock()
+	f, exists := rec.files[rn]
+	if !exists {
+		return
+	}
+	line, err := json.Marshal(RecordedEvent{
+		Room:     rn,
+		Event:    event,
+		To:       to,
+		Response: r,
+	})
+	if err == nil {
+		_, err = f.Write(append(line, '\n'))
+	}
+	if err != nil {
+		log.Error("Unable to record ", event, " in ", rn, ": ", err)
+	}
+}
+
+// Close stops recording the room and closes its file
+func (rec *Recorder) Close(rn string) {
+	if rec == nil {
+		return
+	}
+	rec.protect.Lock()
+	defer rec.protect.Unlock()
+	if f, exists := rec.files[rn]; exists {
+		f.Close()
+		delete(rec.files, rn)
+	}
+}
+
+// CloseAll stops recording every room
+func (rec *Recorder) CloseAll() {
+	if rec == nil {
+		return
+	}
+	rec.protect.Lock()
+	defer rec.protect.Unlock()
+	for rn, f := range rec.files {
+		f.Close()
+		delete(rec.files, rn)
+	}
+}
+
+// recordingBroadcaster records every response it broadcasts to a room that
+// is being recorded.
+type recordingBroadcaster struct {
+	Broadcaster
+	Recorder *Recorder
+}
+
+func (b recordingBroadcaster) BroadcastTo(room, event string, args ...interface{}) {
+	if len(args) > 0 {
+		if r, ok := args[0].(Response); ok {
+			b.Recorder.Record(room, event, nil, r)
+		}
+	}
+	b.Broadcaster.BroadcastTo(room, event, args...)
+}
+
+// ReadRecording reads every event of a room recording
+func ReadRecording(file string) ([]RecordedEvent, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	events := []RecordedEvent{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		e := RecordedEvent{}
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(events) == 0 {
+		return nil, errors.New("Recording is empty")
+	}
+	return events, nil
+}
+
+// ReplayEvents emits the recorded events to the player in the order they were
+// recorded, waiting between them for as long as the room did divided by speed.
+// Events that were sent to a single player are only emitted if they were sent
+// to the given turn. It stops early once done is closed.
+func ReplayEvents(p domain.Comm, events []RecordedEvent, turn int,
+	speed float64, done <-chan struct{}) {
+	var last int64
+	for _, e := range events {
+		if e.To != nil && *e.To != turn {
+			continue
+		}
+		if last != 0 && e.Response.Timestamp > last {
+			wait := time.Duration(float64(e.Response.Timestamp-last) / speed)
+			select {
+			case <-time.After(wait):
+			case <-done:
+				return
+			}
+		}
+		last = e.Response.Timestamp
+		p.Emit(e.Event, e.Response)
+	}
+}
+
+// Replay serves a room recording over socket.io. Every socket that connects
+// is sent the whole recording from the start, as seen by the player whose turn
+// is given. It is served like the server is configured, except for the port
+// and origins given to the command itself.
+func Replay(c *cli.Context) {
+	cfg, err := LoadConfig(c)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ConfigureLogging(cfg.Log)
+	if !c.Args().Present() {
+		log.Fatal("A recording must be given: toto replay <file>")
+	}
+	file := c.Args().First()
+	events, err := ReadRecording(file)
+	if err != nil {
+		log.Fatal(err)
+	}
+	speed := c.Float64("speed")
+	if speed <= 0 {
+		log.Fatal("speed must be greater than 0")
+	}
+	turn := c.Int("turn")
+	server, err := socketio.NewServer(nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	server.On(connection, func(so socketio.Socket) {
+		log.Debug("Replaying", file, "to", so.Id())
+		done := make(chan struct{})
+		so.On(disconnection, func() {
+			close(done)
+		})
+		go ReplayEvents(so, events, turn, speed, done)
+	})
+
+	if c.IsSet("port") {
+		host, _, _ := net.SplitHostPort(cfg.Listen)
+		cfg.Listen = net.JoinHostPort(host, c.String("port"))
+	}
+	if c.IsSet("cors-origins") || c.IsSet("cors-dev") {
+		http.Handle("/socket.io/", corsFromFlags(c, server))
+	} else {
+		http.Handle("/socket.io/", newCORSServer(server, cfg.CORS.Origins, cfg.CORS.Dev))
+	}
+	http.Handle("/", http.FileServer(http.Dir(cfg.StaticDir)))
+	log.Println("Replaying", file, "at "+cfg.Listen)
+	log.Fatal(http.ListenAndServe(cfg.Listen, nil))
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"time"
+
+	"github.com/tiltfactor/toto/domain"
+)
+
+// WatchGames polls the games directory every interval and reloads the games
+// whenever one of its files changes, logging what changed. If the directory
+// can't be read the games that are already loaded are kept. Retired games are
+// removed once their last room has closed.
+func WatchGames(gameDir string, games *domain.GameStore, info Control,
+	interval time.Duration) {
+	last := dirSnapshot(gameDir)
+	for range time.Tick(interval) {
+		if snap := dirSnapshot(gameDir); snap != last {
+			last = snap
+			if fresh, err := ReadGameFiles(gameDir); err != nil {
+				log.Error("Not reloading games: ", err)
+			} else {
+				for _, change := range ReloadGames(games, fresh, info) {
+					log.Println(change)
+				}
+			}
+		}
+		for _, g := range games.All() {
+			if g.Retired && info.Rooms.CountGame(g.UUID) == 0 {
+				games.Del(g.UUID)
+				log.Println("Removed retired game:", g.UUID)
+			}
+		}
+	}
+}
+
+// ReloadGames replaces the stored games with the freshly read ones and returns
+// a description of every change. Games that are still defined keep their
+// Lobby, so players waiting in it stay queued. Games that are no longer
+// defined are retired: no one can join them anymore and their queued players
+// are sent left-queue, but they are only removed once their rooms have closed.
+// Running rooms keep the settings their game had when they started.
+func ReloadGames(games *domain.GameStore, fresh domain.GameMap,
+	info Control) []string {
+	changes := []string{}
+	current := games.All()
+	for key, g := range fresh {
+		old, exists := current[key]
+		if !exists {
+			games.Set(g)
+			changes = append(changes, "Added game: "+key+" from "+g.FileName)
+			continue
+		}
+		g.Lobby = old.Lobby
+		games.Set(g)
+		if old.Retired {
+			changes = append(changes, "Restored retired game: "+key)
+		}
+		for _, d := range GameDiff(old, g) {
+			changes = append(changes, "Updated game: "+key+" "+d)
+		}
+	}
+	for key, old := range current {
+		if _, exists := fresh[key]; exists || old.Retired {
+			continue
+		}
+		old.Retired = true
+		games.Set(old)
+		for _, p := range old.Lobby.Drain() {
+			info.QueueMap.Del(p.Comm.Id())
+			data := map[string]interface{}{}
+			data["gameId"] = key
+			data["reason"] = "Game is no longer available"
+			p.Comm.Emit(leftQueue, WrapResponse(leftQueue, data))
+		}
+		changes = append(changes, "Retired game: "+key+" from "+old.FileName)
+	}
+	return changes
+}
+
+// GameDiff describes the settings that differ between two definitions of a
+// game, using the keys of the game file.
+func GameDiff(old, new domain.Game) []string {
+	diff := []string{}
+	ov, nv := reflect.ValueOf(old), reflect.ValueOf(new)
+	t := ov.Type()
+	for i := 0; i < t.NumField(); i++ {
+		key := t.Field(i).Tag.Get("toml")
+		if key == "" || key == "-" {
+			continue
+		}
+		a, b := ov.Field(i).Interface(), nv.Field(i).Interface()
+		if !reflect.DeepEqual(a, b) {
+			diff = append(diff, fmt.Sprintf("%s: %v -> %v", key, a, b))
+		}
+	}
+	return diff
+}
+
+// dirSnapshot returns a fingerprint of the names, sizes and modification
+// times of the files in the directory. It changes whenever a file does.
+func dirSnapshot(dir string) string {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return ""
+	}
+	snap := ""
+	for _, f := range files {
+		snap += fmt.Sprintf("%s %d %d\n", f.Name(), f.Size(), f.ModTime().UnixNano())
+	}
+	return snap
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"sync"
+	"time"
+
+	"github.com/tiltfactor/toto/domain"
+	"github.com/tiltfactor/toto/utils"
+)
+
+// Drainer records that the server is shutting down. While it drains no new
+// rooms are started and the running ones have until the deadline to finish.
+type Drainer struct {
+	protect  *sync.RWMutex
+	draining bool
+	deadline time.Time
+}
+
+// NewDrainer instantiates a new drainer for a server that is running
+func NewDrainer() *Drainer {
+	return &Drainer{protect: &sync.RWMutex{}}
+}
+
+// Start starts draining until the deadline. It returns false if the server
+// was already draining, in which case the first deadline is kept.
+func (d *Drainer) Start(deadline time.Time) bool {
+	d.protect.Lock()
+	defer d.protect.Unlock()
+	if d.draining {
+		return false
+	}
+	d.draining = true
+	d.deadline = deadline
+	return true
+}
+
+// Draining returns true once the server is shutting down
+func (d *Drainer) Draining() bool {
+	d.protect.RLock()
+	defer d.protect.RUnlock()
+	return d.draining
+}
+
+// Deadline returns when the server stops, it is zero while it isn't draining
+func (d *Drainer) Deadline() time.Time {
+	d.protect.RLock()
+	defer d.protect.RUnlock()
+	return d.deadline
+}
+
+// rejectWhileDraining emits a client error and returns true if the server is
+// shutting down, it is meant for the handlers that would start a new room.
+func rejectWhileDraining(so domain.Comm, info Control) bool {
+	if !info.Drainer.Draining() {
+		return false
+	}
+	so.Emit(clientError, ErrorResponse(clientError, "Server is shutting down"))
+	return true
+}
+
+// DrainServer stops the server from starting new rooms and tells every room
+// and waiting player that it is shutting down with server-shutdown. Queued
+// players are removed from their queue and private rooms are discarded. It
+// then waits for the rooms to finish until the grace period runs out, closes
+// the rooms that are left and stops recording.
+func DrainServer(games *domain.GameStore, info Control, grace time.Duration,
+	poll time.Duration) {
+	deadline := time.Now().Add(grace)
+	if !info.Drainer.Start(deadline) {
+		return
+	}
+	data := map[string]interface{}{}
+	data["deadline"] = deadline.UnixNano()
+	data["timeoutSeconds"] = int(grace / time.Second)
+	r := WrapResponse(serverShutdown, data)
+
+	queued := info.QueueMap.Keys()
+	private := info.PrivateRooms.All()
+	rooms := info.Rooms.All()
+	log.Println("Shutting down, draining", len(rooms), "room(s),",
+		len(private), "private room(s) and", len(queued), "queued player(s)")
+	for _, id := range queued {
+		info.Broadcaster.BroadcastTo(id, serverShutdown, r)
+		DequeuePlayer(id, games, info)
+	}
+	for _, pr := range private {
+		// The room may have started since it was listed.
+		if pr, ok := info.PrivateRooms.Take(pr.Code); ok {
+			for _, p := range pr.Players {
+				p.Comm.Emit(serverShutdown, r)
+			}
+		}
+	}
+	for _, room := range rooms {
+		info.Broadcaster.BroadcastTo(room.Name, serverShutdown, r)
+	}
+
+	for len(info.Rooms.All()) > 0 && time.Now().Before(deadline) {
+		time.Sleep(poll)
+	}
+	for _, room := range info.Rooms.All() {
+		CloseRoom(room.Name, serverShutdown, info)
+	}
+	info.Recorder.CloseAll()
+}
+
+// LogMetrics writes the final value of the metrics to the log so that what
+// happened since they were last scraped isn't lost.
+func LogMetrics() {
+	var buf bytes.Buffer
+	err := utils.WriteMetrics(&buf, metrics.Sockets, metrics.RoomsCreated,
+		metrics.Moves, metrics.Errors, metrics.QueueWait)
+	if err != nil {
+		log.Error("Unable to write metrics: ", err)
+		return
+	}
+	log.Println("Final metrics:\n" + buf.String())
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/tiltfactor/toto/utils"
+)
+
+// certReloader holds the certificate served over TLS and loads it again from
+// its files when asked to, so that a renewed certificate is picked up without
+// restarting the server. Connections that are already open are not affected.
+type certReloader struct {
+	CertFile string
+	KeyFile  string
+	protect  *sync.RWMutex
+	cert     *tls.Certificate
+}
+
+// newCertReloader instantiates a new reloader with the certificate loaded
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	cr := &certReloader{
+		CertFile: certFile,
+		KeyFile:  keyFile,
+		protect:  &sync.RWMutex{},
+	}
+	if err := cr.Reload(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// Reload loads the certificate from its files. The previous certificate is
+// kept if they can't be loaded.
+func (cr *certReloader) Reload() error {
+	cert, err := tls.LoadX509KeyPair(cr.CertFile, cr.KeyFile)
+	if err != nil {
+		return err
+	}
+	cr.protect.Lock()
+	defer cr.protect.Unlock()
+	cr.cert = &cert
+	return nil
+}
+
+// GetCertificate returns the current certificate, it is meant for
+// tls.Config.GetCertificate.
+func (cr *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate,
+	error) {
+	cr.protect.RLock()
+	defer cr.protect.RUnlock()
+	return cr.cert, nil
+}
+
+// ReloadOnHangup reloads the certificate whenever the process receives SIGHUP
+func (cr *certReloader) ReloadOnHangup() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		if err := cr.Reload(); err != nil {
+			log.Error("Unable to reload the TLS certificate: ", err)
+			continue
+		}
+		log.Println("Reloaded the TLS certificate from", cr.CertFile)
+	}
+}
+
+// TLSConfig returns the TLS configuration set up by the tls settings, or nil
+// if the server should serve plain HTTP.
+func TLSConfig(s TLSSettings) (*tls.Config, error) {
+	certFile, keyFile, selfSigned := s.Cert, s.Key, s.SelfSigned
+	switch {
+	case (certFile == "") != (keyFile == ""):
+		return nil, errors.New("tls-cert and tls-key must be given together")
+	case selfSigned && certFile != "":
+		return nil, errors.New("tls-self-signed can't be used with tls-cert")
+	case selfSigned:
+		certPEM, keyPEM, err := utils.SelfSignedCert(
+			[]string{"localhost", "127.0.0.1", "::1"}, 30*24*time.Hour)
+		if err != nil {
+			return nil, err
+		}
+		cert, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			return nil, err
+		}
+		log.Warn("Serving a self-signed certificate, this is only meant for development")
+		return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+	case certFile != "":
+		cr, err := newCertReloader(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		go cr.ReloadOnHangup()
+		return &tls.Config{GetCertificate: cr.GetCertificate}, nil
+	}
+	return nil, nil
+}
+
+// Listen listens at the address, over TLS unless the config is nil
+func Listen(addr string, config *tls.Config) (net.Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil || config == nil {
+		return ln, err
+	}
+	return tls.NewListener(ln, config), nil
+}
+
+// RedirectToHTTPS redirects every request to the same URL over HTTPS on the
+// given port.
+func RedirectToHTTPS(port string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		if port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(),
+			http.StatusMovedPermanently)
+	})
+}
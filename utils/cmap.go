@@ -41,6 +41,17 @@ func (csm *ConcurrentStringMap) Del(key string) {
 	delete(csm.data, key)
 }
 
+// Keys returns a copy of the keys currently in the map
+func (csm *ConcurrentStringMap) Keys() []string {
+	csm.RLock()
+	defer csm.RUnlock()
+	keys := make([]string, 0, len(csm.data))
+	for key := range csm.data {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
 // ConcurrentStringIntMap ...
 type ConcurrentStringIntMap struct {
 	data map[string]int
@@ -0,0 +1,365 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Schema is a compiled JSON Schema. It supports the validation keywords that
+// are useful for describing game moves: type, enum, const, properties,
+// required, additionalProperties, items, minItems, maxItems, minimum, maximum,
+// exclusiveMinimum, exclusiveMaximum, minLength, maxLength, pattern, allOf,
+// anyOf, oneOf and not. Annotations such as title or description are ignored
+// and references ($ref) are rejected when compiling.
+type Schema struct {
+	types                []string
+	enum                 []interface{}
+	constant             interface{}
+	hasConst             bool
+	properties           map[string]*Schema
+	required             []string
+	additionalProperties *Schema
+	noAdditional         bool
+	items                *Schema
+	minItems, maxItems   *int
+	minimum, maximum     *float64
+	exclusiveMin         *float64
+	exclusiveMax         *float64
+	minLength, maxLength *int
+	pattern              *regexp.Regexp
+	allOf, anyOf, oneOf  []*Schema
+	not                  *Schema
+}
+
+// SchemaError describes a value that does not match its schema. Path is a
+// JSON pointer to the value, "/" being the document itself.
+type SchemaError struct {
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+func (e SchemaError) Error() string {
+	return e.Path + ": " + e.Message
+}
+
+// CompileSchema parses and compiles a JSON Schema document
+func CompileSchema(raw []byte) (*Schema, error) {
+	var doc interface{}
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return nil, err
+	}
+	return compileSchema(doc, "/")
+}
+
+func compileSchema(doc interface{}, at string) (*Schema, error) {
+	if b, isBool := doc.(bool); isBool {
+		// true accepts anything while false accepts nothing.
+		if b {
+			return &Schema{}, nil
+		}
+		return &Schema{not: &Schema{}}, nil
+	}
+	m, isObject := doc.(map[string]interface{})
+	if !isObject {
+		return nil, fmt.Errorf("%s: schema must be an object", at)
+	}
+	if _, exists := m["$ref"]; exists {
+		return nil, fmt.Errorf("%s: $ref is not supported", at)
+	}
+	s := &Schema{}
+	var err error
+	for key, v := range m {
+		kat := strings.TrimSuffix(at, "/") + "/" + key
+		switch key {
+		case "type":
+			s.types, err = stringList(v, kat)
+		case "enum":
+			list, isList := v.([]interface{})
+			if !isList {
+				err = fmt.Errorf("%s: must be an array", kat)
+			}
+			s.enum = list
+		case "const":
+			s.constant, s.hasConst = v, true
+		case "properties":
+			s.properties, err = schemaMap(v, kat)
+		case "required":
+			s.required, err = stringList(v, kat)
+		case "additionalProperties":
+			if b, isBool := v.(bool); isBool {
+				s.noAdditional = !b
+				continue
+			}
+			s.additionalProperties, err = compileSchema(v, kat)
+		case "items":
+			s.items, err = compileSchema(v, kat)
+		case "minItems":
+			s.minItems, err = count(v, kat)
+		case "maxItems":
+			s.maxItems, err = count(v, kat)
+		case "minLength":
+			s.minLength, err = count(v, kat)
+		case "maxLength":
+			s.maxLength, err = count(v, kat)
+		case "minimum":
+			s.minimum, err = number(v, kat)
+		case "maximum":
+			s.maximum, err = number(v, kat)
+		case "exclusiveMinimum":
+			s.exclusiveMin, err = number(v, kat)
+		case "exclusiveMaximum":
+			s.exclusiveMax, err = number(v, kat)
+		case "pattern":
+			p, isString := v.(string)
+			if !isString {
+				err = fmt.Errorf("%s: must be a string", kat)
+				break
+			}
+			s.pattern, err = regexp.Compile(p)
+		case "allOf":
+			s.allOf, err = schemaList(v, kat)
+		case "anyOf":
+			s.anyOf, err = schemaList(v, kat)
+		case "oneOf":
+			s.oneOf, err = schemaList(v, kat)
+		case "not":
+			s.not, err = compileSchema(v, kat)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Validate checks the value, as decoded by encoding/json, against the schema
+// and returns every problem it finds ordered by path.
+func (s *Schema) Validate(v interface{}) []SchemaError {
+	errs := s.validate(v, "")
+	sort.Stable(byPath(errs))
+	return errs
+}
+
+type byPath []SchemaError
+
+func (b byPath) Len() int           { return len(b) }
+func (b byPath) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byPath) Less(i, j int) bool { return b[i].Path < b[j].Path }
+
+func (s *Schema) validate(v interface{}, path string) []SchemaError {
+	errs := []SchemaError{}
+	fail := func(format string, args ...interface{}) {
+		p := path
+		if p == "" {
+			p = "/"
+		}
+		errs = append(errs, SchemaError{Path: p, Message: fmt.Sprintf(format, args...)})
+	}
+	if len(s.types) > 0 && !matchesType(v, s.types) {
+		fail("expected %s but got %s", strings.Join(s.types, " or "), typeOf(v))
+		return errs
+	}
+	if len(s.enum) > 0 {
+		found := false
+		for _, e := range s.enum {
+			if reflect.DeepEqual(e, v) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			fail("must be one of the enumerated values")
+		}
+	}
+	if s.hasConst && !reflect.DeepEqual(s.constant, v) {
+		fail("must be equal to the constant value")
+	}
+	switch value := v.(type) {
+	case map[string]interface{}:
+		for _, key := range s.required {
+			if _, exists := value[key]; !exists {
+				fail("missing required property %q", key)
+			}
+		}
+		for key, child := range value {
+			cp := path + "/" + escapePointer(key)
+			if ps, exists := s.properties[key]; exists {
+				errs = append(errs, ps.validate(child, cp)...)
+			} else if s.noAdditional {
+				errs = append(errs, SchemaError{Path: cp, Message: "property is not allowed"})
+			} else if s.additionalProperties != nil {
+				errs = append(errs, s.additionalProperties.validate(child, cp)...)
+			}
+		}
+	case []interface{}:
+		if s.minItems != nil && len(value) < *s.minItems {
+			fail("must have at least %d items", *s.minItems)
+		}
+		if s.maxItems != nil && len(value) > *s.maxItems {
+			fail("must have at most %d items", *s.maxItems)
+		}
+		if s.items != nil {
+			for i, child := range value {
+				errs = append(errs, s.items.validate(child, path+"/"+strconv.Itoa(i))...)
+			}
+		}
+	case float64:
+		if s.minimum != nil && value < *s.minimum {
+			fail("must be at least %v", *s.minimum)
+		}
+		if s.maximum != nil && value > *s.maximum {
+			fail("must be at most %v", *s.maximum)
+		}
+		if s.exclusiveMin != nil && value <= *s.exclusiveMin {
+			fail("must be greater than %v", *s.exclusiveMin)
+		}
+		if s.exclusiveMax != nil && value >= *s.exclusiveMax {
+			fail("must be less than %v", *s.exclusiveMax)
+		}
+	case string:
+		length := utf8.RuneCountInString(value)
+		if s.minLength != nil && length < *s.minLength {
+			fail("must be at least %d characters long", *s.minLength)
+		}
+		if s.maxLength != nil && length > *s.maxLength {
+			fail("must be at most %d characters long", *s.maxLength)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(value) {
+			fail("must match the pattern %q", s.pattern.String())
+		}
+	}
+	for _, sub := range s.allOf {
+		errs = append(errs, sub.validate(v, path)...)
+	}
+	if len(s.anyOf) > 0 && countMatches(s.anyOf, v, path) == 0 {
+		fail("must match at least one of the anyOf schemas")
+	}
+	if len(s.oneOf) > 0 && countMatches(s.oneOf, v, path) != 1 {
+		fail("must match exactly one of the oneOf schemas")
+	}
+	if s.not != nil && len(s.not.validate(v, path)) == 0 {
+		fail("must not match the schema")
+	}
+	return errs
+}
+
+func countMatches(schemas []*Schema, v interface{}, path string) int {
+	matches := 0
+	for _, sub := range schemas {
+		if len(sub.validate(v, path)) == 0 {
+			matches++
+		}
+	}
+	return matches
+}
+
+func matchesType(v interface{}, types []string) bool {
+	actual := typeOf(v)
+	for _, t := range types {
+		if t == actual || (t == "number" && actual == "integer") {
+			return true
+		}
+	}
+	return false
+}
+
+func typeOf(v interface{}) string {
+	switch value := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case float64:
+		if value == math.Trunc(value) {
+			return "integer"
+		}
+		return "number"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return "unknown"
+}
+
+// escapePointer escapes a property name for use in a JSON pointer
+func escapePointer(key string) string {
+	return strings.Replace(strings.Replace(key, "~", "~0", -1), "/", "~1", -1)
+}
+
+func stringList(v interface{}, at string) ([]string, error) {
+	if s, isString := v.(string); isString {
+		return []string{s}, nil
+	}
+	list, isList := v.([]interface{})
+	if !isList {
+		return nil, fmt.Errorf("%s: must be a string or an array of strings", at)
+	}
+	out := make([]string, len(list))
+	for i, item := range list {
+		s, isString := item.(string)
+		if !isString {
+			return nil, fmt.Errorf("%s: must be a string or an array of strings", at)
+		}
+		out[i] = s
+	}
+	return out, nil
+}
+
+func schemaMap(v interface{}, at string) (map[string]*Schema, error) {
+	m, isObject := v.(map[string]interface{})
+	if !isObject {
+		return nil, fmt.Errorf("%s: must be an object", at)
+	}
+	out := make(map[string]*Schema, len(m))
+	for key, doc := range m {
+		s, err := compileSchema(doc, at+"/"+escapePointer(key))
+		if err != nil {
+			return nil, err
+		}
+		out[key] = s
+	}
+	return out, nil
+}
+
+func schemaList(v interface{}, at string) ([]*Schema, error) {
+	list, isList := v.([]interface{})
+	if !isList || len(list) == 0 {
+		return nil, fmt.Errorf("%s: must be a non-empty array", at)
+	}
+	out := make([]*Schema, len(list))
+	for i, doc := range list {
+		s, err := compileSchema(doc, at+"/"+strconv.Itoa(i))
+		if err != nil {
+			return nil, err
+		}
+		out[i] = s
+	}
+	return out, nil
+}
+
+func number(v interface{}, at string) (*float64, error) {
+	n, isNumber := v.(float64)
+	if !isNumber {
+		return nil, fmt.Errorf("%s: must be a number", at)
+	}
+	return &n, nil
+}
+
+func count(v interface{}, at string) (*int, error) {
+	n, isNumber := v.(float64)
+	if !isNumber || n < 0 || n != math.Trunc(n) {
+		return nil, fmt.Errorf("%s: must be a non-negative integer", at)
+	}
+	c := int(n)
+	return &c, nil
+}
@@ -0,0 +1,105 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+// Errors returned when verifying a token
+var (
+	ErrMalformedToken   = errors.New("Malformed token")
+	ErrUnsupportedAlg   = errors.New("Token must be signed with HS256")
+	ErrBadSignature     = errors.New("Invalid token signature")
+	ErrTokenExpired     = errors.New("Token has expired")
+	ErrTokenNotYetValid = errors.New("Token is not valid yet")
+	ErrNoSubject        = errors.New("Token has no subject")
+)
+
+// Claims are the registered JWT claims that are understood. Times are in
+// seconds since the epoch and zero when they are left out.
+type Claims struct {
+	Subject   string `json:"sub"`
+	ExpiresAt int64  `json:"exp,omitempty"`
+	NotBefore int64  `json:"nbf,omitempty"`
+	IssuedAt  int64  `json:"iat,omitempty"`
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ,omitempty"`
+}
+
+var encoding = base64.RawURLEncoding
+
+// SignToken returns a JWT holding the claims signed with HMAC-SHA256
+func SignToken(c Claims, secret []byte) (string, error) {
+	header, err := json.Marshal(jwtHeader{Alg: "HS256", Typ: "JWT"})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	signed := encoding.EncodeToString(header) + "." + encoding.EncodeToString(payload)
+	return signed + "." + encoding.EncodeToString(sign(signed, secret)), nil
+}
+
+// VerifyToken checks that the JWT was signed with HMAC-SHA256 using the secret
+// and that it is valid at the given time. It returns its claims if it is.
+func VerifyToken(token string, secret []byte, now time.Time) (Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return Claims{}, ErrMalformedToken
+	}
+	header := jwtHeader{}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return Claims{}, err
+	}
+	// Checking the algorithm first keeps "none" and public key algorithms out.
+	if header.Alg != "HS256" {
+		return Claims{}, ErrUnsupportedAlg
+	}
+	sig, err := encoding.DecodeString(parts[2])
+	if err != nil {
+		return Claims{}, ErrMalformedToken
+	}
+	if !hmac.Equal(sig, sign(parts[0]+"."+parts[1], secret)) {
+		return Claims{}, ErrBadSignature
+	}
+	c := Claims{}
+	if err := decodeSegment(parts[1], &c); err != nil {
+		return Claims{}, err
+	}
+	switch {
+	case c.ExpiresAt != 0 && now.Unix() >= c.ExpiresAt:
+		return Claims{}, ErrTokenExpired
+	case c.NotBefore != 0 && now.Unix() < c.NotBefore:
+		return Claims{}, ErrTokenNotYetValid
+	case c.Subject == "":
+		return Claims{}, ErrNoSubject
+	}
+	return c, nil
+}
+
+func sign(signed string, secret []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(signed))
+	return mac.Sum(nil)
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	b, err := encoding.DecodeString(segment)
+	if err != nil {
+		return ErrMalformedToken
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return ErrMalformedToken
+	}
+	return nil
+}
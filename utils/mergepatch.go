@@ -0,0 +1,23 @@
+package utils
+
+// MergePatch applies a JSON merge patch (RFC 7386) to the target and returns
+// the result. Both are expected to be decoded with encoding/json, objects
+// present in the target are modified in place.
+func MergePatch(target, patch interface{}) interface{} {
+	p, isObject := patch.(map[string]interface{})
+	if !isObject {
+		return patch
+	}
+	t, isObject := target.(map[string]interface{})
+	if !isObject {
+		t = map[string]interface{}{}
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(t, k)
+			continue
+		}
+		t[k] = MergePatch(t[k], v)
+	}
+	return t
+}
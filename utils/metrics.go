@@ -0,0 +1,302 @@
+package utils
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Metric is a family of samples that can be written in the Prometheus text
+// exposition format.
+type Metric interface {
+	WriteMetric(w io.Writer) error
+}
+
+// WriteMetrics writes every metric to w in the Prometheus text exposition
+// format, in the order they are given.
+func WriteMetrics(w io.Writer, metrics ...Metric) error {
+	for _, m := range metrics {
+		if err := m.WriteMetric(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// desc holds what every kind of metric has in common
+type desc struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+}
+
+func (d desc) writeHeader(w io.Writer) error {
+	_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", d.name,
+		strings.Replace(d.help, "\n", " ", -1), d.name, d.kind)
+	return err
+}
+
+// key joins label values into a map key. It panics if the number of values
+// doesn't match the number of labels since that is a programming error.
+func (d desc) key(values []string) string {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("%s: expected %d label values but got %d", d.name,
+			len(d.labels), len(values)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+// labelPairs formats the label values of a key, along with any extra pairs,
+// as {a="x",b="y"}. It returns an empty string when there are no labels.
+func (d desc) labelPairs(key string, extra ...string) string {
+	pairs := []string{}
+	if len(d.labels) > 0 {
+		for i, v := range strings.Split(key, "\xff") {
+			pairs = append(pairs, d.labels[i]+"="+quoteLabel(v))
+		}
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+"="+quoteLabel(extra[i+1]))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func quoteLabel(v string) string {
+	v = strings.Replace(v, `\`, `\\`, -1)
+	v = strings.Replace(v, "\n", `\n`, -1)
+	return `"` + strings.Replace(v, `"`, `\"`, -1) + `"`
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// valueSet is a threadsafe set of values keyed by label values, it backs both
+// counters and gauges.
+type valueSet struct {
+	desc
+	protect *sync.Mutex
+	values  map[string]float64
+}
+
+func newValueSet(kind, name, help string, labels []string) *valueSet {
+	return &valueSet{
+		desc:    desc{name: name, help: help, kind: kind, labels: labels},
+		protect: &sync.Mutex{},
+		values:  make(map[string]float64),
+	}
+}
+
+func (vs *valueSet) add(v float64, labelValues []string) {
+	k := vs.key(labelValues)
+	vs.protect.Lock()
+	defer vs.protect.Unlock()
+	vs.values[k] += v
+}
+
+func (vs *valueSet) get(labelValues []string) float64 {
+	k := vs.key(labelValues)
+	vs.protect.Lock()
+	defer vs.protect.Unlock()
+	return vs.values[k]
+}
+
+// WriteMetric writes the values ordered by their labels
+func (vs *valueSet) WriteMetric(w io.Writer) error {
+	vs.protect.Lock()
+	defer vs.protect.Unlock()
+	if err := vs.writeHeader(w); err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(vs.values))
+	for k := range vs.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	if len(keys) == 0 && len(vs.labels) == 0 {
+		keys = append(keys, "")
+	}
+	for _, k := range keys {
+		_, err := fmt.Fprintf(w, "%s%s %s\n", vs.name, vs.labelPairs(k),
+			formatValue(vs.values[k]))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Counter is a threadsafe value that only goes up, one per combination of
+// label values.
+type Counter struct {
+	*valueSet
+}
+
+// NewCounter instantiates a new counter with the given label names
+func NewCounter(name, help string, labels ...string) *Counter {
+	return &Counter{newValueSet("counter", name, help, labels)}
+}
+
+// Inc adds one to the counter with the given label values
+func (c *Counter) Inc(labelValues ...string) {
+	c.add(1, labelValues)
+}
+
+// Get returns the value of the counter with the given label values
+func (c *Counter) Get(labelValues ...string) float64 {
+	return c.get(labelValues)
+}
+
+// Gauge is a threadsafe value that can go up and down, one per combination of
+// label values.
+type Gauge struct {
+	*valueSet
+}
+
+// NewGauge instantiates a new gauge with the given label names
+func NewGauge(name, help string, labels ...string) *Gauge {
+	return &Gauge{newValueSet("gauge", name, help, labels)}
+}
+
+// Add adds v, which may be negative, to the gauge with the given label values
+func (g *Gauge) Add(v float64, labelValues ...string) {
+	g.add(v, labelValues)
+}
+
+// Get returns the value of the gauge with the given label values
+func (g *Gauge) Get(labelValues ...string) float64 {
+	return g.get(labelValues)
+}
+
+// GaugeFunc is a gauge whose values are collected when it is written. Collect
+// is called with a function that sets the value for the given label values.
+type GaugeFunc struct {
+	desc
+	collect func(set func(v float64, labelValues ...string))
+}
+
+// NewGaugeFunc instantiates a new gauge that is collected when it is written
+func NewGaugeFunc(name, help string, labels []string,
+	collect func(set func(v float64, labelValues ...string))) *GaugeFunc {
+	return &GaugeFunc{
+		desc:    desc{name: name, help: help, kind: "gauge", labels: labels},
+		collect: collect,
+	}
+}
+
+// WriteMetric collects the values and writes them ordered by their labels
+func (gf *GaugeFunc) WriteMetric(w io.Writer) error {
+	vs := newValueSet(gf.kind, gf.name, gf.help, gf.labels)
+	gf.collect(func(v float64, labelValues ...string) {
+		vs.values[vs.key(labelValues)] = v
+	})
+	return vs.WriteMetric(w)
+}
+
+// DefaultBuckets are histogram buckets, in seconds, that suit waits ranging
+// from a moment to several minutes.
+var DefaultBuckets = []float64{0.5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600}
+
+// Histogram is a threadsafe count of observations in buckets, one per
+// combination of label values. Buckets are given by their upper bound.
+type Histogram struct {
+	desc
+	buckets []float64
+	protect *sync.Mutex
+	values  map[string]*histogramValue
+}
+
+type histogramValue struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// NewHistogram instantiates a new histogram with the given sorted buckets and
+// label names.
+func NewHistogram(name, help string, buckets []float64,
+	labels ...string) *Histogram {
+	return &Histogram{
+		desc:    desc{name: name, help: help, kind: "histogram", labels: labels},
+		buckets: buckets,
+		protect: &sync.Mutex{},
+		values:  make(map[string]*histogramValue),
+	}
+}
+
+// Observe records v in the histogram with the given label values
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	k := h.key(labelValues)
+	h.protect.Lock()
+	defer h.protect.Unlock()
+	hv, exists := h.values[k]
+	if !exists {
+		hv = &histogramValue{counts: make([]uint64, len(h.buckets))}
+		h.values[k] = hv
+	}
+	for i, upper := range h.buckets {
+		if v <= upper {
+			hv.counts[i]++
+		}
+	}
+	hv.count++
+	hv.sum += v
+}
+
+// Count returns the number of observations in the histogram with the given
+// label values.
+func (h *Histogram) Count(labelValues ...string) uint64 {
+	k := h.key(labelValues)
+	h.protect.Lock()
+	defer h.protect.Unlock()
+	if hv, exists := h.values[k]; exists {
+		return hv.count
+	}
+	return 0
+}
+
+// WriteMetric writes the cumulative buckets, sum and count ordered by labels
+func (h *Histogram) WriteMetric(w io.Writer) error {
+	h.protect.Lock()
+	defer h.protect.Unlock()
+	if err := h.writeHeader(w); err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(h.values))
+	for k := range h.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		hv := h.values[k]
+		lines := []string{}
+		for i, upper := range h.buckets {
+			lines = append(lines, fmt.Sprintf("%s_bucket%s %d", h.name,
+				h.labelPairs(k, "le", formatValue(upper)), hv.counts[i]))
+		}
+		lines = append(lines,
+			fmt.Sprintf("%s_bucket%s %d", h.name, h.labelPairs(k, "le", "+Inf"), hv.count),
+			fmt.Sprintf("%s_sum%s %s", h.name, h.labelPairs(k), formatValue(hv.sum)),
+			fmt.Sprintf("%s_count%s %d", h.name, h.labelPairs(k), hv.count))
+		if _, err := io.WriteString(w, strings.Join(lines, "\n")+"\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/BurntSushi/toml"
+	"github.com/codegangsta/cli"
+	"github.com/tiltfactor/toto/domain"
+	"github.com/tiltfactor/toto/utils"
+)
+
+// GameProblem describes something wrong with a game file. Fatal problems make
+// the game unusable, the others are mistakes such as keys that are not read.
+type GameProblem struct {
+	File    string
+	Key     string
+	Message string
+	Fatal   bool
+}
+
+func (p GameProblem) Error() string {
+	if p.Key == "" {
+		return p.File + ": " + p.Message
+	}
+	return p.File + ": " + p.Key + ": " + p.Message
+}
+
+// CheckGameFiles reads every game file in the directory and returns the games
+// that could be loaded along with every problem found in the files.
+func CheckGameFiles(gameDir string) (domain.GameMap, []GameProblem) {
+	gm := domain.GameMap{}
+	files, err := filepath.Glob(gameDir + "/*.toml")
+	if err != nil || len(files) == 0 {
+		return gm, []GameProblem{{
+			File:    gameDir,
+			Message: "Unable to find games. Does games directory exist?",
+			Fatal:   true,
+		}}
+	}
+	problems := []GameProblem{}
+	for _, f := range files {
+		g, found := CheckGameFile(gameDir, f)
+		problems = append(problems, found...)
+		if other, exists := gm[g.UUID]; exists && g.UUID != "" {
+			problems = append(problems, GameProblem{
+				File:    f,
+				Key:     "uniqueKey",
+				Message: "conflicts with " + other.FileName,
+				Fatal:   true,
+			})
+			continue
+		}
+		if !hasFatal(found) {
+			gm[g.UUID] = g
+		}
+	}
+	return gm, problems
+}
+
+// CheckGameFile reads a single game file and returns the game it defines along
+// with every problem found in it.
+func CheckGameFile(gameDir, f string) (domain.Game, []GameProblem) {
+	problems := []GameProblem{}
+	fail := func(key, msg string) {
+		problems = append(problems, GameProblem{
+			File:    f,
+			Key:     key,
+			Message: msg,
+			Fatal:   true,
+		})
+	}
+	warn := func(key, msg string) {
+		problems = append(problems, GameProblem{File: f, Key: key, Message: msg})
+	}
+	dummy := domain.Game{}
+	meta, err := toml.DecodeFile(f, &dummy)
+	if err != nil {
+		fail("", "Invalid configuration: "+err.Error())
+		return dummy, problems
+	}
+	for _, key := range meta.Undecoded() {
+		warn(key.String(), "unknown key")
+	}
+	if dummy.MinPlayers <= 0 {
+		fail("minPlayers", "must be provided and greater than 0")
+	}
+	if dummy.MaxPlayers != 0 && dummy.MaxPlayers < dummy.MinPlayers {
+		fail("maxPlayers", fmt.Sprintf("must not be less than minPlayers (%d)",
+			dummy.MinPlayers))
+	}
+	if dummy.Title == "" {
+		warn("displayTitle", "should be provided")
+	}
+	if dummy.UUID == "" {
+		fail("uniqueKey", "must be provided")
+	}
+	if dummy.FillTimeout < 0 {
+		fail("fillTimeout", "must not be negative")
+	}
+	if dummy.TurnMode != domain.TurnModeFree &&
+		dummy.TurnMode != domain.TurnModeStrict {
+		fail("turnMode", "must be \"strict\" or left out")
+	}
+	if dummy.TurnTimeoutSeconds < 0 {
+		fail("turnTimeoutSeconds", "must not be negative")
+	}
+	if dummy.TurnTimeoutPolicy != "" &&
+		dummy.TurnTimeoutPolicy != domain.TimeoutPolicySkip &&
+		dummy.TurnTimeoutPolicy != domain.TimeoutPolicyEnd {
+		fail("turnTimeoutPolicy", "must be \"skip\" or \"end\"")
+	}
+	if dummy.ReadyCheckSeconds < 0 {
+		fail("readyCheckSeconds", "must not be negative")
+	}
+	if t := dummy.Teams; t != (domain.Teams{}) {
+		groupSize := dummy.MaxPlayers
+		if groupSize == 0 {
+			groupSize = dummy.MinPlayers
+		}
+		switch {
+		case t.Count < 2:
+			fail("teams.count", "must be at least 2")
+		case t.Size < 0:
+			fail("teams.size", "must not be negative")
+		case t.Size > 0 && t.Count*t.Size < groupSize:
+			fail("teams.size", fmt.Sprintf("%d teams of %d can't hold %d players",
+				t.Count, t.Size, groupSize))
+		}
+		if t.Strategy != "" && t.Strategy != domain.TeamsRoundRobin &&
+			t.Strategy != domain.TeamsRandom &&
+			t.Strategy != domain.TeamsPartyPreserving {
+			fail("teams.strategy",
+				"must be \"round-robin\", \"random\" or \"party-preserving\"")
+		}
+	}
+	if dummy.MaxSpectators < 0 {
+		fail("maxSpectators", "must not be negative")
+	}
+	if dummy.Matchmaking != domain.MatchmakingFIFO &&
+		dummy.Matchmaking != domain.MatchmakingRating {
+		fail("matchmaking", "must be \"rating\" when given")
+	}
+	if dummy.RatingSpread < 0 {
+		fail("ratingSpread", "must not be negative")
+	}
+	if dummy.RatingSpreadGrowth < 0 {
+		fail("ratingSpreadGrowth", "must not be negative")
+	}
+	var validator *utils.Schema
+	if dummy.MoveSchema != "" {
+		raw, err := ioutil.ReadFile(filepath.Join(gameDir, dummy.MoveSchema))
+		if err != nil {
+			fail("moveSchema", "Unable to read: "+err.Error())
+		} else if validator, err = utils.CompileSchema(raw); err != nil {
+			fail("moveSchema", "Invalid schema: "+err.Error())
+		}
+	}
+	g := domain.Game{
+		MinPlayers:         dummy.MinPlayers,
+		MaxPlayers:         dummy.MaxPlayers,
+		FillTimeout:        dummy.FillTimeout,
+		TurnMode:           dummy.TurnMode,
+		TurnTimeoutSeconds: dummy.TurnTimeoutSeconds,
+		TurnTimeoutPolicy:  dummy.TurnTimeoutPolicy,
+		MoveSchema:         dummy.MoveSchema,
+		ReadyCheckSeconds:  dummy.ReadyCheckSeconds,
+		Teams:              dummy.Teams,
+		DisableSpectators:  dummy.DisableSpectators,
+		MaxSpectators:      dummy.MaxSpectators,
+		Matchmaking:        dummy.Matchmaking,
+		RatingSpread:       dummy.RatingSpread,
+		RatingSpreadGrowth: dummy.RatingSpreadGrowth,
+		MoveValidator:      validator,
+		Title:              dummy.Title,
+		UUID:               dummy.UUID,
+		Lobby:              domain.NewLobby(),
+	}
+	g.FileName = f
+	return g, problems
+}
+
+// ValidateGames checks every game file in the configured games directory, or
+// in the directory given as the first argument, and prints every problem it
+// finds.
+// It exits with a non-zero status if there are any so that it can be used in
+// scripts and hooks.
+func ValidateGames(c *cli.Context) {
+	cfg, err := LoadConfig(c)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	gameDir := cfg.GamesDir
+	if c.Args().Present() {
+		gameDir = c.Args().First()
+	}
+	_, problems := CheckGameFiles(gameDir)
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+	if len(problems) > 0 {
+		fmt.Printf("%d problem(s) found\n", len(problems))
+		os.Exit(1)
+	}
+	fmt.Println("All game files in", gameDir, "are valid")
+}
+
+func hasFatal(problems []GameProblem) bool {
+	for _, p := range problems {
+		if p.Fatal {
+			return true
+		}
+	}
+	return false
+}